@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	log_v1 "github.com/reversearrow/distributed-computing-in-go/api/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// consume prints the records from an offset to the end of the log, or
+// as they are appended when following the log.
+func consume(ctx context.Context, client log_v1.LogClient, t target, args []string, stdio stdio) error {
+	fs := flag.NewFlagSet("consume", flag.ContinueOnError)
+	fs.SetOutput(stdio.err)
+	offset := fs.Uint64("offset", 0, "offset of the first record")
+	follow := fs.Bool("follow", false, "wait for new records at the end of the log")
+	group := fs.String("group", "", "consumer group to start from the committed offset of")
+	format := fs.String("format", "raw", "output format: raw, json or hex")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	printRecord, ok := printers[*format]
+	if !ok {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	var end uint64
+	if !*follow {
+		// the records are printed up to the end of the log as it is
+		// now, so the group's committed offset is looked up here.
+		if *group != "" {
+			res, err := client.FetchCommittedOffset(ctx, &log_v1.FetchCommittedOffsetRequest{
+				Group:     *group,
+				Topic:     t.topic,
+				Partition: t.partition,
+			})
+			switch {
+			case err == nil:
+				*offset = res.Offset
+			case status.Code(err) != codes.NotFound:
+				return err
+			}
+			*group = ""
+		}
+
+		info, err := client.GetLogInfo(ctx, &log_v1.GetLogInfoRequest{
+			Topic:     t.topic,
+			Partition: t.partition,
+		})
+		if err != nil {
+			return err
+		}
+		end = info.HighWatermark
+		if *offset >= end {
+			return nil
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := client.ConsumeStream(ctx, &log_v1.ConsumeRequest{
+		Offset:    *offset,
+		Topic:     t.topic,
+		Partition: t.partition,
+		Group:     *group,
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		res, err := stream.Recv()
+		if errors.Is(err, io.EOF) || status.Code(err) == codes.Canceled {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := printRecord(stdio.out, res.Record); err != nil {
+			return err
+		}
+		if !*follow && res.Record.Offset+1 >= end {
+			return nil
+		}
+	}
+}
+
+// printer prints a record to w.
+type printer func(w io.Writer, r *log_v1.Record) error
+
+var printers = map[string]printer{
+	"raw":  printRaw,
+	"json": printJSON,
+	"hex":  printHex,
+}
+
+// printRaw prints the record's value on a line.
+func printRaw(w io.Writer, r *log_v1.Record) error {
+	_, err := fmt.Fprintf(w, "%s\n", r.Value)
+	return err
+}
+
+type jsonRecord struct {
+	Offset     uint64       `json:"offset"`
+	Key        string       `json:"key,omitempty"`
+	Value      string       `json:"value"`
+	Headers    []jsonHeader `json:"headers,omitempty"`
+	Timestamp  *time.Time   `json:"timestamp,omitempty"`
+	AppendTime *time.Time   `json:"append_time,omitempty"`
+}
+
+// jsonHeader is a header of a jsonRecord. Headers are listed in order
+// as a key may be repeated.
+type jsonHeader struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// printJSON prints the record as a JSON object on a line. Keys and
+// values that are not valid UTF-8 are better printed as hex.
+func printJSON(w io.Writer, r *log_v1.Record) error {
+	jr := jsonRecord{
+		Offset: r.Offset,
+		Key:    string(r.Key),
+		Value:  string(r.Value),
+	}
+	for _, h := range r.Headers {
+		jr.Headers = append(jr.Headers, jsonHeader{Key: h.Key, Value: h.Value})
+	}
+	if r.Timestamp != nil {
+		ts := r.Timestamp.AsTime()
+		jr.Timestamp = &ts
+	}
+	if r.AppendTime != nil {
+		at := r.AppendTime.AsTime()
+		jr.AppendTime = &at
+	}
+	return json.NewEncoder(w).Encode(jr)
+}
+
+// printHex prints the record's offset, then dumps its key and value.
+func printHex(w io.Writer, r *log_v1.Record) error {
+	if _, err := fmt.Fprintf(w, "offset %d\n", r.Offset); err != nil {
+		return err
+	}
+	if len(r.Key) > 0 {
+		if _, err := fmt.Fprintf(w, "key\n%s", hex.Dump(r.Key)); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "value\n%s", hex.Dump(r.Value))
+	return err
+}
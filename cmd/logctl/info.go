@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"text/tabwriter"
+	"time"
+
+	log_v1 "github.com/reversearrow/distributed-computing-in-go/api/v1"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// info prints the watermarks and segments of the log.
+func info(ctx context.Context, client log_v1.LogClient, t target, args []string, stdio stdio) error {
+	fs := flag.NewFlagSet("info", flag.ContinueOnError)
+	fs.SetOutput(stdio.err)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	res, err := client.GetLogInfo(ctx, &log_v1.GetLogInfoRequest{
+		Topic:     t.topic,
+		Partition: t.partition,
+	})
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(stdio.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "low watermark:\t%d\n", res.LowWatermark)
+	fmt.Fprintf(w, "high watermark:\t%d\n", res.HighWatermark)
+	fmt.Fprintf(w, "segments:\t%d\n", res.SegmentCount)
+	fmt.Fprintf(w, "size:\t%d\n", res.Size)
+	fmt.Fprintf(w, "last append:\t%s\n", formatTime(res.LastAppendTime))
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "BASE\tNEXT\tSIZE\tLAST APPEND")
+	for _, s := range res.Segments {
+		fmt.Fprintf(w, "%d\t%d\t%d\t%s\n",
+			s.BaseOffset, s.NextOffset, s.Size, formatTime(s.LastAppendTime))
+	}
+	return w.Flush()
+}
+
+func formatTime(ts *timestamppb.Timestamp) string {
+	if ts == nil {
+		return "-"
+	}
+	return ts.AsTime().Format(time.RFC3339)
+}
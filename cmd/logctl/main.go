@@ -0,0 +1,126 @@
+// Command logctl produces to, consumes from and inspects the log served
+// by logd, or inspects the files of a log without a server.
+//
+//	logctl [flags] produce [-key key | -key-separator sep] [file...]
+//	logctl [flags] consume [-offset n] [-follow] [-format raw|json|hex]
+//	logctl [flags] info
+//	logctl segments list|verify -dir dir
+//	logctl segments rebuild-index -dir dir [-max-index-bytes n]
+//	logctl segments dump -dir dir [-from n] [-to n] [-format raw|json|hex] [-index]
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log_v1 "github.com/reversearrow/distributed-computing-in-go/api/v1"
+	"github.com/reversearrow/distributed-computing-in-go/internal/config"
+	"github.com/reversearrow/distributed-computing-in-go/internal/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+// command runs a subcommand with its args against client.
+type command func(ctx context.Context, client log_v1.LogClient, target target, args []string, stdio stdio) error
+
+var commands = map[string]command{
+	"produce": produce,
+	"consume": consume,
+	"info":    info,
+}
+
+// offlineCommands run without connecting to a server.
+var offlineCommands = map[string]func(args []string, stdio stdio) error{
+	"segments": segments,
+}
+
+// target is the log commands operate on.
+type target struct {
+	topic     string
+	partition uint32
+}
+
+type stdio struct {
+	in       io.Reader
+	out, err io.Writer
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	err := run(ctx, os.Args[1:], stdio{in: os.Stdin, out: os.Stdout, err: os.Stderr})
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "logctl:", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string, stdio stdio) error {
+	fs := flag.NewFlagSet("logctl", flag.ContinueOnError)
+	fs.SetOutput(stdio.err)
+	addr := fs.String("addr", "localhost:8400", "address of the server")
+	caFile := fs.String("ca-file", "", "CA verifying the server, connects with TLS when set")
+	certFile := fs.String("cert-file", "", "client certificate")
+	keyFile := fs.String("key-file", "", "client certificate's key")
+	serverName := fs.String("server-name", "", "name the server's certificate is verified against, the host of -addr when empty")
+	subject := fs.String("subject", "", "name to authenticate as when connecting without TLS")
+	topic := fs.String("topic", "", "topic to operate on, the default log when empty")
+	partition := fs.Uint("partition", 0, "partition of the topic")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: logctl [flags] produce|consume|info|segments [command flags]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	if cmd, ok := offlineCommands[fs.Arg(0)]; ok {
+		return cmd(fs.Args()[1:], stdio)
+	}
+	cmd, ok := commands[fs.Arg(0)]
+	if !ok {
+		return fmt.Errorf("unknown command %q", fs.Arg(0))
+	}
+
+	creds := insecure.NewCredentials()
+	if *caFile != "" {
+		tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+			CertFile:      *certFile,
+			KeyFile:       *keyFile,
+			CAFile:        *caFile,
+			ServerAddress: *serverName,
+		})
+		if err != nil {
+			return err
+		}
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	if *subject != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, server.SubjectMetadataKey, *subject)
+	}
+
+	conn, err := grpc.DialContext(ctx, *addr, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	t := target{topic: *topic, partition: uint32(*partition)}
+	return cmd(ctx, log_v1.NewLogClient(conn), t, fs.Args()[1:], stdio)
+}
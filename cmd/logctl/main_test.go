@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	log_v1 "github.com/reversearrow/distributed-computing-in-go/api/v1"
+	"github.com/reversearrow/distributed-computing-in-go/internal/log"
+	"github.com/reversearrow/distributed-computing-in-go/internal/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogctl(t *testing.T) {
+	addr := serve(t)
+	ctx := context.Background()
+
+	logctl := func(stdin string, args ...string) (string, error) {
+		var out bytes.Buffer
+		err := run(ctx, append([]string{"-addr", addr}, args...), stdio{
+			in:  strings.NewReader(stdin),
+			out: &out,
+			err: &bytes.Buffer{},
+		})
+		return out.String(), err
+	}
+
+	_, err := logctl("a\tfirst\nb\tsecond\nthird\n", "produce", "-key-separator", "\t", "-batch", "2")
+	require.NoError(t, err)
+
+	dir, err := os.MkdirTemp("", "logctl-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "records")
+	require.NoError(t, os.WriteFile(file, []byte("fourth\n"), 0600))
+	_, err = logctl("", "produce", "-key", "d", file)
+	require.NoError(t, err)
+
+	out, err := logctl("", "consume")
+	require.NoError(t, err)
+	require.Equal(t, "first\nsecond\nthird\nfourth\n", out)
+
+	out, err = logctl("", "consume", "-offset", "1", "-format", "json")
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	require.Len(t, lines, 3)
+	var record jsonRecord
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &record))
+	require.Equal(t, uint64(1), record.Offset)
+	require.Equal(t, "b", record.Key)
+	require.Equal(t, "second", record.Value)
+	require.NotNil(t, record.AppendTime)
+	require.NoError(t, json.Unmarshal([]byte(lines[2]), &record))
+	require.Equal(t, "d", record.Key)
+
+	out, err = logctl("", "consume", "-offset", "3", "-format", "hex")
+	require.NoError(t, err)
+	require.Contains(t, out, "offset 3\n")
+	require.Contains(t, out, "66 6f 75 72 74 68") // fourth
+
+	out, err = logctl("", "consume", "-offset", "4")
+	require.NoError(t, err)
+	require.Empty(t, out)
+
+	out, err = logctl("", "info")
+	require.NoError(t, err)
+	require.Regexp(t, `high watermark:\s+4`, out)
+
+	_, err = logctl("", "consume", "-format", "xml")
+	require.Error(t, err)
+	_, err = logctl("", "unknown")
+	require.Error(t, err)
+}
+
+func TestLogctlFollow(t *testing.T) {
+	addr := serve(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	out := &syncBuffer{}
+	done := make(chan error, 1)
+	go func() {
+		done <- run(ctx, []string{"-addr", addr, "consume", "-follow"}, stdio{
+			out: out,
+			err: &bytes.Buffer{},
+		})
+	}()
+
+	err := run(context.Background(), []string{"-addr", addr, "produce"}, stdio{
+		in:  strings.NewReader("hello world\n"),
+		out: &bytes.Buffer{},
+		err: &bytes.Buffer{},
+	})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return out.String() == "hello world\n"
+	}, time.Second, 10*time.Millisecond)
+
+	cancel()
+	require.NoError(t, <-done)
+}
+
+func serve(t *testing.T) string {
+	t.Helper()
+
+	dir, err := os.MkdirTemp("", "logctl-test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	t.Cleanup(func() { clog.Close() })
+
+	srv, err := server.NewGRPCServer(&server.Config{CommitLog: clog})
+	require.NoError(t, err)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(ln)
+	t.Cleanup(srv.Stop)
+
+	return ln.Addr().String()
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestPrintJSON(t *testing.T) {
+	var out bytes.Buffer
+	require.NoError(t, printJSON(&out, &log_v1.Record{
+		Offset: 7,
+		Value:  []byte("hello world"),
+		Headers: []*log_v1.Header{
+			{Key: "trace-id", Value: "abc"},
+			{Key: "tag", Value: "b"},
+			{Key: "tag", Value: "a"},
+		},
+	}))
+	require.JSONEq(t, `{
+		"offset": 7,
+		"value": "hello world",
+		"headers": [
+			{"key": "trace-id", "value": "abc"},
+			{"key": "tag", "value": "b"},
+			{"key": "tag", "value": "a"}
+		]
+	}`, out.String())
+}
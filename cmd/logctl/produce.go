@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	log_v1 "github.com/reversearrow/distributed-computing-in-go/api/v1"
+)
+
+// maxLineBytes is the size of the largest record produced.
+const maxLineBytes = 1 << 20
+
+// produce appends every line of the files, or of stdin when none is
+// given, as a record.
+func produce(ctx context.Context, client log_v1.LogClient, t target, args []string, stdio stdio) error {
+	fs := flag.NewFlagSet("produce", flag.ContinueOnError)
+	fs.SetOutput(stdio.err)
+	key := fs.String("key", "", "key of every record")
+	keySeparator := fs.String("key-separator", "", "separates the key from the value in every line when set")
+	batchSize := fs.Int("batch", 100, "number of records produced at once")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *batchSize < 1 {
+		return fmt.Errorf("batch must be at least 1, got %d", *batchSize)
+	}
+
+	p := &producer{
+		ctx:       ctx,
+		client:    client,
+		target:    t,
+		batchSize: *batchSize,
+		record: func(line string) *log_v1.Record {
+			r := &log_v1.Record{Value: []byte(line)}
+			if *keySeparator != "" {
+				if i := strings.Index(line, *keySeparator); i >= 0 {
+					r.Key = []byte(line[:i])
+					r.Value = []byte(line[i+len(*keySeparator):])
+				}
+			} else if *key != "" {
+				r.Key = []byte(*key)
+			}
+			return r
+		},
+	}
+
+	if fs.NArg() == 0 {
+		if err := p.produce(stdio.in); err != nil {
+			return err
+		}
+	}
+	for _, name := range fs.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		err = p.produce(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	if err := p.flush(); err != nil {
+		return err
+	}
+
+	if p.count > 0 {
+		fmt.Fprintf(stdio.err, "produced %d records at offsets %d to %d\n", p.count, p.first, p.last)
+	}
+	return nil
+}
+
+type producer struct {
+	ctx       context.Context
+	client    log_v1.LogClient
+	target    target
+	batchSize int
+	record    func(line string) *log_v1.Record
+
+	batch              []*log_v1.Record
+	count, first, last uint64
+}
+
+func (p *producer) produce(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineBytes)
+	for scanner.Scan() {
+		p.batch = append(p.batch, p.record(scanner.Text()))
+		if len(p.batch) == p.batchSize {
+			if err := p.flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+func (p *producer) flush() error {
+	if len(p.batch) == 0 {
+		return nil
+	}
+
+	res, err := p.client.ProduceBatch(p.ctx, &log_v1.ProduceBatchRequest{
+		Records:   p.batch,
+		Topic:     p.target.topic,
+		Partition: p.target.partition,
+	})
+	if err != nil {
+		return err
+	}
+
+	if p.count == 0 {
+		p.first = res.FirstOffset
+	}
+	p.last = res.LastOffset
+	p.count += uint64(len(p.batch))
+	p.batch = p.batch[:0]
+	return nil
+}
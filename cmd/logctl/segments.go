@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"text/tabwriter"
+
+	"github.com/reversearrow/distributed-computing-in-go/internal/log"
+)
+
+// errProblems is returned by segments verify when the log has errors.
+var errProblems = errors.New("the log has errors")
+
+// segments inspects and repairs the files of a log's data directory
+// without a server, so it works on the logs of crashed or stopped
+// servers.
+func segments(args []string, stdio stdio) error {
+	if len(args) == 0 {
+		fmt.Fprintln(stdio.err, "usage: logctl segments list|dump|verify|rebuild-index -dir dir [flags]")
+		return flag.ErrHelp
+	}
+
+	fs := flag.NewFlagSet("segments "+args[0], flag.ContinueOnError)
+	fs.SetOutput(stdio.err)
+	dir := fs.String("dir", "", "directory of the log's segments")
+	var run func() error
+	switch args[0] {
+	case "list":
+		run = func() error { return listSegments(*dir, stdio) }
+	case "dump":
+		from := fs.Uint64("from", 0, "offset of the first record")
+		to := fs.Uint64("to", math.MaxUint64, "offset of the last record")
+		format := fs.String("format", "raw", "output format: raw, json or hex")
+		index := fs.Bool("index", false, "print the index entries of every segment instead of its records")
+		run = func() error {
+			if *index {
+				return dumpIndexes(*dir, *from, *to, stdio)
+			}
+			printRecord, ok := printers[*format]
+			if !ok {
+				return fmt.Errorf("unknown format %q", *format)
+			}
+			return dumpRecords(*dir, *from, *to, printRecord, stdio)
+		}
+	case "verify":
+		run = func() error { return verify(*dir, stdio) }
+	case "rebuild-index":
+		maxIndexBytes := fs.Uint64("max-index-bytes", 0, "max index bytes the log is configured with, the log's default when zero")
+		run = func() error { return rebuildIndexes(*dir, *maxIndexBytes, stdio) }
+	default:
+		return fmt.Errorf("unknown segments command %q", args[0])
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *dir == "" {
+		return errors.New("-dir is required")
+	}
+	return run()
+}
+
+// listSegments prints the segments of the log with their files, and the
+// files that belong to no segment.
+func listSegments(dir string, stdio stdio) error {
+	segments, orphans, err := log.ListSegments(dir)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(stdio.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "BASE\tSTORE SIZE\tINDEX ENTRIES\tTIME INDEX")
+	for _, s := range segments {
+		storeSize, entries, timeIndex := "-", "-", "-"
+		if s.Store != "" {
+			fi, err := os.Stat(s.Store)
+			if err != nil {
+				return err
+			}
+			storeSize = fmt.Sprint(fi.Size())
+		}
+		if s.Index != "" {
+			e, err := log.ReadIndex(s.Index, s.BaseOffset)
+			if err != nil {
+				return err
+			}
+			entries = fmt.Sprint(len(e))
+		}
+		if s.TimeIndex != "" {
+			timeIndex = "yes"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", s.BaseOffset, storeSize, entries, timeIndex)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	for _, orphan := range orphans {
+		fmt.Fprintf(stdio.err, "orphan file %s\n", orphan)
+	}
+	return nil
+}
+
+// dumpIndexes prints the index entries between from and to.
+func dumpIndexes(dir string, from, to uint64, stdio stdio) error {
+	segments, _, err := log.ListSegments(dir)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(stdio.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "OFFSET\tPOSITION\tINDEX")
+	for _, s := range segments {
+		if s.Index == "" {
+			continue
+		}
+		entries, err := log.ReadIndex(s.Index, s.BaseOffset)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.Offset >= from && e.Offset <= to {
+				fmt.Fprintf(w, "%d\t%d\t%s\n", e.Offset, e.Position, s.Index)
+			}
+		}
+	}
+	return w.Flush()
+}
+
+// dumpRecords prints the records between from and to as read from the
+// stores, reporting the frames that cannot be read on stderr.
+func dumpRecords(dir string, from, to uint64, printRecord printer, stdio stdio) error {
+	segments, _, err := log.ListSegments(dir)
+	if err != nil {
+		return err
+	}
+
+	for i, s := range segments {
+		if s.Store == "" || s.BaseOffset > to {
+			continue
+		}
+		// the segment's records all precede the next segment's
+		if i+1 < len(segments) && segments[i+1].BaseOffset <= from {
+			continue
+		}
+		err := log.ScanStore(s.Store, func(f log.Frame) error {
+			for _, r := range f.Records {
+				if r.Offset < from || r.Offset > to {
+					continue
+				}
+				if err := printRecord(stdio.out, r); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		var corrupt log.ErrCorruptRecord
+		if errors.As(err, &corrupt) {
+			fmt.Fprintln(stdio.err, err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verify prints the problems of the log, failing when any is an error.
+func verify(dir string, stdio stdio) error {
+	problems, err := log.Verify(dir)
+	if err != nil {
+		return err
+	}
+
+	var failed bool
+	for _, p := range problems {
+		fmt.Fprintln(stdio.out, p)
+		failed = failed || !p.Warning
+	}
+	if failed {
+		return errProblems
+	}
+	return nil
+}
+
+// rebuildIndexes rebuilds the indexes of the log from its stores.
+func rebuildIndexes(dir string, maxIndexBytes uint64, stdio stdio) error {
+	var c log.Config
+	c.Segment.MaxIndexBytes = maxIndexBytes
+	repairs, err := log.RebuildIndexes(dir, c)
+	for _, r := range repairs {
+		fmt.Fprintln(stdio.out, r)
+	}
+	return err
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	log_v1 "github.com/reversearrow/distributed-computing-in-go/api/v1"
+	"github.com/reversearrow/distributed-computing-in-go/internal/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSegments(t *testing.T) {
+	dir, err := os.MkdirTemp("", "segments-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := log.Config{}
+	c.Segment.MaxIndexBytes = 12 * 2
+	clog, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err := clog.Append(&log_v1.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, clog.Close())
+
+	logctl := func(args ...string) (string, string, error) {
+		var out, errOut bytes.Buffer
+		err := run(context.Background(), append([]string{"segments"}, args...), stdio{
+			in:  strings.NewReader(""),
+			out: &out,
+			err: &errOut,
+		})
+		return out.String(), errOut.String(), err
+	}
+
+	out, _, err := logctl("list", "-dir", dir)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	require.Len(t, lines, 4)
+	require.Regexp(t, `^2\s+\d+\s+2\s+yes$`, lines[2])
+
+	out, _, err = logctl("dump", "-dir", dir, "-from", "1", "-to", "3")
+	require.NoError(t, err)
+	require.Equal(t, "record 1\nrecord 2\nrecord 3\n", out)
+
+	out, _, err = logctl("dump", "-dir", dir, "-index", "-from", "4")
+	require.NoError(t, err)
+	require.Regexp(t, `\n4\s+0\s+\S+4\.index\n$`, out)
+
+	out, _, err = logctl("verify", "-dir", dir)
+	require.NoError(t, err)
+	require.Empty(t, out)
+
+	// points offset 3 to the frame holding offset 2
+	index := make([]byte, 24)
+	index[3] = 1
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "2.index"), index, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "stray"), nil, 0644))
+	out, _, err = logctl("verify", "-dir", dir)
+	require.ErrorIs(t, err, errProblems)
+	require.Contains(t, out, "warning: "+filepath.Join(dir, "stray"))
+	require.Contains(t, out, "offset 3 points to the frame at pos 0, which does not hold it")
+
+	out, _, err = logctl("rebuild-index", "-dir", dir, "-max-index-bytes", "24")
+	require.NoError(t, err)
+	require.Contains(t, out, filepath.Join(dir, "2.store")+": reindexed 2 records")
+	out, _, err = logctl("verify", "-dir", dir)
+	require.NoError(t, err)
+	require.Equal(t, "warning: "+filepath.Join(dir, "stray")+": file belongs to no segment\n", out)
+
+	_, _, err = logctl("verify")
+	require.Error(t, err)
+	_, _, err = logctl("unknown", "-dir", dir)
+	require.Error(t, err)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix prefixes the environment variables setting a flag, e.g.
+// LOGD_DATA_DIR sets -data-dir.
+const envPrefix = "LOGD_"
+
+// Config configures the server. It is loaded from, in increasing order
+// of precedence, its defaults, the YAML config file, the environment
+// and the command line flags.
+type Config struct {
+	// ConfigFile is the YAML file the configuration is read from.
+	ConfigFile string `yaml:"-"`
+
+	DataDir string `yaml:"data_dir"`
+	// RPCAddr is the address gRPC is served on.
+	RPCAddr string `yaml:"rpc_addr"`
+
+	Segment struct {
+		MaxStoreBytes uint64 `yaml:"max_store_bytes"`
+		MaxIndexBytes uint64 `yaml:"max_index_bytes"`
+	} `yaml:"segment"`
+
+	Retention struct {
+		MaxAge   time.Duration `yaml:"max_age"`
+		MaxBytes uint64        `yaml:"max_bytes"`
+	} `yaml:"retention"`
+
+	TLS struct {
+		CertFile string `yaml:"cert_file"`
+		KeyFile  string `yaml:"key_file"`
+		// CAFile verifies client certificates, which are required
+		// when it is set.
+		CAFile string `yaml:"ca_file"`
+	} `yaml:"tls"`
+
+	ACLPolicyFile string `yaml:"acl_policy_file"`
+
+	// MaxPartitions bounds the partitions a topic is created with.
+	MaxPartitions uint `yaml:"max_partitions"`
+
+	// GroupSessionTimeout is how long a consumer group member stays
+	// in its group without heartbeating.
+	GroupSessionTimeout time.Duration `yaml:"group_session_timeout"`
+
+	// ShutdownTimeout is how long in-flight calls are given to finish
+	// on shutdown before they are cancelled.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+}
+
+func defaultConfig() Config {
+	var c Config
+	c.DataDir = "data"
+	c.RPCAddr = ":8400"
+	c.Segment.MaxStoreBytes = 64 << 20
+	c.Segment.MaxIndexBytes = 1 << 20
+	c.MaxPartitions = 256
+	c.GroupSessionTimeout = 10 * time.Second
+	c.ShutdownTimeout = 10 * time.Second
+	return c
+}
+
+func (c *Config) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("logd", flag.ContinueOnError)
+	fs.StringVar(&c.ConfigFile, "config", c.ConfigFile, "YAML file to read the configuration from")
+	fs.StringVar(&c.DataDir, "data-dir", c.DataDir, "directory the logs are stored in")
+	fs.StringVar(&c.RPCAddr, "rpc-addr", c.RPCAddr, "address to serve gRPC on")
+	fs.Uint64Var(&c.Segment.MaxStoreBytes, "segment-max-store-bytes", c.Segment.MaxStoreBytes, "size of a segment's store before it is rolled")
+	fs.Uint64Var(&c.Segment.MaxIndexBytes, "segment-max-index-bytes", c.Segment.MaxIndexBytes, "size of a segment's index before it is rolled")
+	fs.DurationVar(&c.Retention.MaxAge, "retention-max-age", c.Retention.MaxAge, "age of the segments removed, never when zero")
+	fs.Uint64Var(&c.Retention.MaxBytes, "retention-max-bytes", c.Retention.MaxBytes, "size of a log above which segments are removed, unlimited when zero")
+	fs.StringVar(&c.TLS.CertFile, "tls-cert-file", c.TLS.CertFile, "server certificate, gRPC is served without TLS when empty")
+	fs.StringVar(&c.TLS.KeyFile, "tls-key-file", c.TLS.KeyFile, "server certificate's key")
+	fs.StringVar(&c.TLS.CAFile, "tls-ca-file", c.TLS.CAFile, "CA verifying the required client certificates")
+	fs.StringVar(&c.ACLPolicyFile, "acl-policy-file", c.ACLPolicyFile, "policy authorizing clients, every call is permitted when empty")
+	fs.UintVar(&c.MaxPartitions, "max-partitions", c.MaxPartitions, "partitions a topic is created with at most")
+	fs.DurationVar(&c.GroupSessionTimeout, "group-session-timeout", c.GroupSessionTimeout, "time a consumer group member stays without heartbeating")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "time in-flight calls are given to finish on shutdown")
+	return fs
+}
+
+// loadConfig returns the configuration set by the command line args,
+// the environment and the config file they name.
+func loadConfig(args []string, getenv func(string) string) (Config, error) {
+	c := defaultConfig()
+	fs := c.flagSet()
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+	if fs.NArg() > 0 {
+		return Config{}, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	// the flags set are applied again once the file and environment
+	// are loaded, so that they take precedence.
+	set := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = f.Value.String()
+	})
+
+	if c.ConfigFile == "" {
+		c.ConfigFile = getenv(envName("config"))
+	}
+	if c.ConfigFile != "" {
+		b, err := os.ReadFile(c.ConfigFile)
+		if err != nil {
+			return Config{}, err
+		}
+		if err := yaml.Unmarshal(b, &c); err != nil {
+			return Config{}, fmt.Errorf("%s: %w", c.ConfigFile, err)
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || f.Name == "config" {
+			return
+		}
+		name := envName(f.Name)
+		if v := getenv(name); v != "" {
+			if setErr := fs.Set(f.Name, v); setErr != nil {
+				err = fmt.Errorf("%s: %w", name, setErr)
+			}
+		}
+	})
+	if err != nil {
+		return Config{}, err
+	}
+
+	for name, v := range set {
+		if err := fs.Set(name, v); err != nil {
+			return Config{}, err
+		}
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return Config{}, errors.New("tls-cert-file and tls-key-file must be set together")
+	}
+	return c, nil
+}
+
+// envName returns the environment variable setting the flag.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := os.MkdirTemp("", "logd-config-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "logd.yaml")
+	require.NoError(t, os.WriteFile(file, []byte(`
+data_dir: /var/lib/logd
+rpc_addr: ":9000"
+segment:
+  max_store_bytes: 1024
+retention:
+  max_age: 24h
+max_partitions: 16
+tls:
+  cert_file: server.pem
+  key_file: server-key.pem
+`), 0600))
+
+	env := map[string]string{
+		"LOGD_RPC_ADDR":                ":9001",
+		"LOGD_RETENTION_MAX_BYTES":     "4096",
+		"LOGD_SEGMENT_MAX_STORE_BYTES": "2048",
+	}
+	getenv := func(key string) string { return env[key] }
+
+	c, err := loadConfig([]string{
+		"-config", file,
+		"-segment-max-store-bytes", "8192",
+	}, getenv)
+	require.NoError(t, err)
+
+	// the file overrides the defaults
+	require.Equal(t, "/var/lib/logd", c.DataDir)
+	require.Equal(t, 24*time.Hour, c.Retention.MaxAge)
+	require.Equal(t, "server.pem", c.TLS.CertFile)
+	require.Equal(t, uint64(1<<20), c.Segment.MaxIndexBytes)
+	require.Equal(t, uint(16), c.MaxPartitions)
+	// the environment overrides the file
+	require.Equal(t, ":9001", c.RPCAddr)
+	require.Equal(t, uint64(4096), c.Retention.MaxBytes)
+	// and the flags override the environment
+	require.Equal(t, uint64(8192), c.Segment.MaxStoreBytes)
+
+	// the config file is found through the environment too
+	env["LOGD_CONFIG"] = file
+	c, err = loadConfig(nil, getenv)
+	require.NoError(t, err)
+	require.Equal(t, "/var/lib/logd", c.DataDir)
+	require.Equal(t, uint64(2048), c.Segment.MaxStoreBytes)
+
+	env["LOGD_RETENTION_MAX_BYTES"] = "lots"
+	_, err = loadConfig(nil, getenv)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "LOGD_RETENTION_MAX_BYTES")
+
+	_, err = loadConfig([]string{"serve"}, func(string) string { return "" })
+	require.Error(t, err)
+
+	// a certificate is useless without its key
+	_, err = loadConfig([]string{"-tls-cert-file", "server.pem"}, func(string) string { return "" })
+	require.Error(t, err)
+	_, err = loadConfig([]string{"-tls-key-file", "server-key.pem"}, func(string) string { return "" })
+	require.Error(t, err)
+}
@@ -0,0 +1,218 @@
+// Command logd serves the log, its topics and consumer groups over gRPC.
+//
+// On SIGINT or SIGTERM it stops accepting calls, ends the consume
+// streams waiting for records, gives the in-flight calls
+// ShutdownTimeout to finish, cancels the ones still running and closes
+// the logs, flushing every segment.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/reversearrow/distributed-computing-in-go/internal/auth"
+	"github.com/reversearrow/distributed-computing-in-go/internal/config"
+	"github.com/reversearrow/distributed-computing-in-go/internal/group"
+	"github.com/reversearrow/distributed-computing-in-go/internal/log"
+	"github.com/reversearrow/distributed-computing-in-go/internal/server"
+	"github.com/reversearrow/distributed-computing-in-go/internal/topic"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+func main() {
+	c, err := loadConfig(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "logd:", err)
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if err := run(ctx, c, nil); err != nil {
+		fmt.Fprintln(os.Stderr, "logd:", err)
+		os.Exit(1)
+	}
+}
+
+// run serves until ctx is done. The address served on is sent to ready
+// when it is not nil.
+func run(ctx context.Context, c Config, ready chan<- net.Addr) (err error) {
+	d, err := open(c)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := d.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	var opts []grpc.ServerOption
+	if c.TLS.CertFile != "" {
+		tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+			CertFile: c.TLS.CertFile,
+			KeyFile:  c.TLS.KeyFile,
+			CAFile:   c.TLS.CAFile,
+			Server:   true,
+		})
+		if err != nil {
+			return err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	stopping := make(chan struct{})
+	srvConfig := &server.Config{
+		CommitLog:   d.log,
+		Topics:      d.topics,
+		Offsets:     d.offsets,
+		Coordinator: d.coordinator,
+		Done:        stopping,
+	}
+	if c.ACLPolicyFile != "" {
+		authorizer, err := auth.New(c.ACLPolicyFile)
+		if err != nil {
+			return err
+		}
+		srvConfig.Authorizer = authorizer
+	}
+	srv, err := server.NewGRPCServer(srvConfig, opts...)
+	if err != nil {
+		return err
+	}
+
+	ln, err := net.Listen("tcp", c.RPCAddr)
+	if err != nil {
+		return err
+	}
+	if ready != nil {
+		ready <- ln.Addr()
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	// following consumers wait for records until they are told the
+	// server is stopping, the calls still running once the timeout is
+	// up are cancelled.
+	close(stopping)
+	stopped := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(c.ShutdownTimeout):
+		srv.Stop()
+		<-stopped
+	}
+	return nil
+}
+
+// data holds the logs served.
+type data struct {
+	log         *log.Log
+	topics      *topic.Registry
+	offsets     *group.Offsets
+	coordinator *group.Coordinator
+}
+
+// open opens the default log under <data dir>/log, the topics under
+// <data dir>/topics and the consumer group offsets under
+// <data dir>/offsets.
+func open(c Config) (d *data, err error) {
+	var logConfig log.Config
+	logConfig.Segment.MaxStoreBytes = c.Segment.MaxStoreBytes
+	logConfig.Segment.MaxIndexBytes = c.Segment.MaxIndexBytes
+	logConfig.Retention.MaxAge = c.Retention.MaxAge
+	logConfig.Retention.MaxBytes = c.Retention.MaxBytes
+	logConfig.Segment.Report = func(r log.Repair) {
+		fmt.Fprintln(os.Stderr, "logd: repaired", r)
+	}
+
+	d = &data{}
+	defer func() {
+		if err != nil {
+			d.Close()
+		}
+	}()
+
+	logDir := filepath.Join(c.DataDir, "log")
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return nil, err
+	}
+	if d.log, err = log.NewLog(logDir, logConfig); err != nil {
+		return nil, fmt.Errorf("opening log: %w", err)
+	}
+
+	if d.topics, err = topic.NewRegistry(filepath.Join(c.DataDir, "topics"), logConfig); err != nil {
+		return nil, fmt.Errorf("opening topics: %w", err)
+	}
+	d.topics.MaxPartitions = uint32(c.MaxPartitions)
+
+	// offsets are only kept while they are the latest of their group
+	// and partition.
+	offsetsConfig := logConfig
+	offsetsConfig.Retention = log.Retention{}
+	offsetsDir := filepath.Join(c.DataDir, "offsets")
+	if err := os.MkdirAll(offsetsDir, 0755); err != nil {
+		return nil, err
+	}
+	if d.offsets, err = group.NewOffsets(offsetsDir, offsetsConfig); err != nil {
+		return nil, fmt.Errorf("opening offsets: %w", err)
+	}
+
+	d.coordinator = group.NewCoordinator(group.CoordinatorConfig{
+		SessionTimeout: c.GroupSessionTimeout,
+		Partitions: func(name string) (uint32, error) {
+			t, err := d.topics.Get(name)
+			if err != nil {
+				return 0, err
+			}
+			return uint32(len(t.Partitions)), nil
+		},
+	})
+	return d, nil
+}
+
+// Close closes the logs opened, flushing their segments.
+func (d *data) Close() error {
+	var errs []error
+	if d.offsets != nil {
+		errs = append(errs, d.offsets.Close())
+	}
+	if d.topics != nil {
+		errs = append(errs, d.topics.Close())
+	}
+	if d.log != nil {
+		errs = append(errs, d.log.Close())
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	log_v1 "github.com/reversearrow/distributed-computing-in-go/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func TestRun(t *testing.T) {
+	dir, err := os.MkdirTemp("", "logd-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := defaultConfig()
+	c.DataDir = dir
+	c.RPCAddr = "127.0.0.1:0"
+	// streams waiting for records end right away, not when the
+	// timeout is up
+	c.ShutdownTimeout = time.Minute
+
+	// the log survives the server restarting
+	var offset uint64
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		ready := make(chan net.Addr, 1)
+		done := make(chan error, 1)
+		go func() {
+			done <- run(ctx, c, ready)
+		}()
+
+		var addr net.Addr
+		select {
+		case addr = <-ready:
+		case err := <-done:
+			t.Fatal(err)
+		}
+		conn, err := grpc.Dial(addr.String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+		require.NoError(t, err)
+		client := log_v1.NewLogClient(conn)
+
+		if i == 0 {
+			res, err := client.Produce(context.Background(), &log_v1.ProduceRequest{
+				Record: &log_v1.Record{Value: []byte("hello world")},
+			})
+			require.NoError(t, err)
+			offset = res.Offset
+
+			_, err = client.CreateTopic(context.Background(), &log_v1.CreateTopicRequest{
+				Name:       "orders",
+				Partitions: 2,
+			})
+			require.NoError(t, err)
+		} else {
+			res, err := client.Consume(context.Background(), &log_v1.ConsumeRequest{Offset: offset})
+			require.NoError(t, err)
+			require.Equal(t, "hello world", string(res.Record.Value))
+
+			topics, err := client.ListTopics(context.Background(), &log_v1.ListTopicsRequest{})
+			require.NoError(t, err)
+			require.Len(t, topics.Topics, 1)
+		}
+
+		// a tailing consumer does not keep the server from stopping
+		stream, err := client.ConsumeStream(context.Background(), &log_v1.ConsumeRequest{Offset: offset + 1})
+		require.NoError(t, err)
+
+		cancel()
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("server did not stop")
+		}
+		_, err = stream.Recv()
+		require.Equal(t, codes.Unavailable, status.Code(err))
+		conn.Close()
+	}
+}
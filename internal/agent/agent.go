@@ -0,0 +1,230 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/reversearrow/distributed-computing-in-go/internal/auth"
+	"github.com/reversearrow/distributed-computing-in-go/internal/discovery"
+	"github.com/reversearrow/distributed-computing-in-go/internal/log"
+	"github.com/reversearrow/distributed-computing-in-go/internal/server"
+	"github.com/soheilhy/cmux"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+const leaderTimeout = 3 * time.Second
+
+// Config configures an Agent.
+type Config struct {
+	// DataDir is where the replicated log is stored.
+	DataDir string
+	// BindAddr is the address cluster membership is gossiped on.
+	BindAddr string
+	// RPCPort is the port gRPC and raft are served on, on the host
+	// of BindAddr.
+	RPCPort int
+	// NodeName identifies the server in the cluster.
+	NodeName string
+	// StartJoinAddrs are the gossip addresses of servers of the
+	// cluster to join.
+	StartJoinAddrs []string
+	// Bootstrap starts a new cluster with this server as its leader.
+	Bootstrap bool
+	// ServerTLSConfig secures the gRPC service and the raft
+	// connections accepted by the server, both are plaintext when nil.
+	ServerTLSConfig *tls.Config
+	// PeerTLSConfig secures the raft connections to the other servers.
+	PeerTLSConfig *tls.Config
+	// ACLPolicyFile is the policy authorizing clients, see
+	// auth.Authorizer. Every call is permitted when it is empty.
+	ACLPolicyFile string
+	// CommitLog configures the replicated log, its raft stream layer,
+	// local ID and bootstrapping are set by the agent.
+	CommitLog log.Config
+}
+
+// RPCAddr returns the address gRPC and raft are served on.
+func (c Config) RPCAddr() (string, error) {
+	host, _, err := net.SplitHostPort(c.BindAddr)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:%d", host, c.RPCPort), nil
+}
+
+// Agent runs a server of the cluster: the replicated log and the gRPC
+// service in front of it, multiplexed on a single port. Servers that
+// join the cluster's gossip become replicas of the log.
+type Agent struct {
+	Config
+
+	mux        cmux.CMux
+	log        *log.DistributedLog
+	server     *grpc.Server
+	membership *discovery.Membership
+	// stopping ends the consume streams waiting for records on
+	// shutdown.
+	stopping chan struct{}
+
+	shutdown     bool
+	shutdownLock sync.Mutex
+}
+
+// New starts an agent with the given configuration.
+func New(config Config) (*Agent, error) {
+	a := &Agent{
+		Config:   config,
+		stopping: make(chan struct{}),
+	}
+
+	setup := []func() error{
+		a.setupMux,
+		a.setupLog,
+		a.setupServer,
+		a.setupMembership,
+	}
+	for _, fn := range setup {
+		if err := fn(); err != nil {
+			a.Shutdown()
+			return nil, err
+		}
+	}
+
+	go a.serve()
+	return a, nil
+}
+
+func (a *Agent) setupMux() error {
+	rpcAddr, err := a.RPCAddr()
+	if err != nil {
+		return err
+	}
+
+	ln, err := net.Listen("tcp", rpcAddr)
+	if err != nil {
+		return err
+	}
+	a.mux = cmux.New(ln)
+	return nil
+}
+
+func (a *Agent) setupLog() error {
+	raftLn := a.mux.Match(func(r io.Reader) bool {
+		b := make([]byte, 1)
+		if _, err := r.Read(b); err != nil {
+			return false
+		}
+		return bytes.Equal(b, []byte{byte(log.RaftRPC)})
+	})
+
+	logConfig := a.CommitLog
+	logConfig.Raft.StreamLayer = log.NewStreamLayer(raftLn, a.ServerTLSConfig, a.PeerTLSConfig)
+	logConfig.Raft.LocalID = raft.ServerID(a.NodeName)
+	logConfig.Raft.Bootstrap = a.Bootstrap
+
+	var err error
+	a.log, err = log.NewDistributedLog(a.DataDir, logConfig)
+	if err != nil {
+		return err
+	}
+	if a.Bootstrap {
+		return a.log.WaitForLeader(leaderTimeout)
+	}
+	return nil
+}
+
+func (a *Agent) setupServer() error {
+	var opts []grpc.ServerOption
+	if a.ServerTLSConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(a.ServerTLSConfig)))
+	}
+
+	serverConfig := &server.Config{
+		CommitLog:   a.log,
+		GetServerer: a.log,
+		Done:        a.stopping,
+	}
+	if a.ACLPolicyFile != "" {
+		authorizer, err := auth.New(a.ACLPolicyFile)
+		if err != nil {
+			return err
+		}
+		serverConfig.Authorizer = authorizer
+	}
+
+	var err error
+	a.server, err = server.NewGRPCServer(serverConfig, opts...)
+	if err != nil {
+		return err
+	}
+
+	grpcLn := a.mux.Match(cmux.Any())
+	go func() {
+		if err := a.server.Serve(grpcLn); err != nil {
+			_ = a.Shutdown()
+		}
+	}()
+	return nil
+}
+
+// setupMembership gossips the RPC address of the server, the log is
+// told about the servers joining and leaving.
+func (a *Agent) setupMembership() error {
+	rpcAddr, err := a.RPCAddr()
+	if err != nil {
+		return err
+	}
+
+	a.membership, err = discovery.New(a.log, discovery.Config{
+		NodeName: a.NodeName,
+		BindAddr: a.BindAddr,
+		Tags: map[string]string{
+			discovery.RPCAddrTag: rpcAddr,
+		},
+		StartJoinAddrs: a.StartJoinAddrs,
+	})
+	return err
+}
+
+func (a *Agent) serve() {
+	if err := a.mux.Serve(); err != nil {
+		_ = a.Shutdown()
+	}
+}
+
+// Shutdown stops serving and closes the log. It is safe to call more
+// than once.
+func (a *Agent) Shutdown() error {
+	a.shutdownLock.Lock()
+	defer a.shutdownLock.Unlock()
+	if a.shutdown {
+		return nil
+	}
+	a.shutdown = true
+
+	// every step runs even when an earlier one failed, so nothing is
+	// left running.
+	var errs []error
+	if a.membership != nil {
+		errs = append(errs, a.membership.Leave())
+	}
+	close(a.stopping)
+	if a.server != nil {
+		a.server.GracefulStop()
+	}
+	if a.mux != nil {
+		a.mux.Close()
+	}
+	if a.log != nil {
+		errs = append(errs, a.log.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,164 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log_v1 "github.com/reversearrow/distributed-computing-in-go/api/v1"
+	"github.com/reversearrow/distributed-computing-in-go/internal/config"
+	"github.com/reversearrow/distributed-computing-in-go/internal/loadbalance"
+	"github.com/reversearrow/distributed-computing-in-go/internal/testutil"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+func TestAgent(t *testing.T) {
+	certDir, err := os.MkdirTemp("", "agent-test-certs")
+	require.NoError(t, err)
+	defer os.RemoveAll(certDir)
+
+	ca, err := testutil.NewCA(certDir)
+	require.NoError(t, err)
+	serverCert, serverKey, err := ca.Issue("server", "127.0.0.1")
+	require.NoError(t, err)
+	clientCert, clientKey, err := ca.Issue("client")
+	require.NoError(t, err)
+
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: serverCert,
+		KeyFile:  serverKey,
+		CAFile:   ca.CAFile,
+		Server:   true,
+	})
+	require.NoError(t, err)
+	// servers dial their peers with their own certificate
+	peerTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      serverCert,
+		KeyFile:       serverKey,
+		CAFile:        ca.CAFile,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	clientTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      clientCert,
+		KeyFile:       clientKey,
+		CAFile:        ca.CAFile,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	creds := credentials.NewTLS(clientTLSConfig)
+
+	policyFile := filepath.Join(certDir, "policy")
+	err = os.WriteFile(policyFile, []byte("client * *\n"), 0600)
+	require.NoError(t, err)
+
+	var agents []*Agent
+	for i := 0; i < 3; i++ {
+		dataDir, err := os.MkdirTemp("", "agent-test")
+		require.NoError(t, err)
+		defer os.RemoveAll(dataDir)
+
+		var startJoinAddrs []string
+		if i > 0 {
+			startJoinAddrs = []string{agents[0].BindAddr}
+		}
+
+		agentConfig := Config{
+			DataDir:         dataDir,
+			BindAddr:        fmt.Sprintf("127.0.0.1:%d", freePort(t)),
+			RPCPort:         freePort(t),
+			NodeName:        fmt.Sprintf("%d", i),
+			StartJoinAddrs:  startJoinAddrs,
+			Bootstrap:       i == 0,
+			ServerTLSConfig: serverTLSConfig,
+			PeerTLSConfig:   peerTLSConfig,
+			ACLPolicyFile:   policyFile,
+		}
+		agentConfig.CommitLog.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		agentConfig.CommitLog.Raft.ElectionTimeout = 50 * time.Millisecond
+		agentConfig.CommitLog.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		agentConfig.CommitLog.Raft.CommitTimeout = 5 * time.Millisecond
+
+		agent, err := New(agentConfig)
+		require.NoError(t, err)
+		defer agent.Shutdown()
+		agents = append(agents, agent)
+	}
+
+	ctx := context.Background()
+	leader := client(t, agents[0], creds)
+	produce, err := leader.Produce(ctx, &log_v1.ProduceRequest{
+		Record: &log_v1.Record{Value: []byte("foo")},
+	})
+	require.NoError(t, err)
+
+	// the servers discovered through gossip became replicas, raft and
+	// gRPC share their port.
+	for _, agent := range agents {
+		c := client(t, agent, creds)
+		require.Eventually(t, func() bool {
+			consume, err := c.Consume(ctx, &log_v1.ConsumeRequest{
+				Offset: produce.Offset,
+			})
+			return err == nil && string(consume.Record.Value) == "foo"
+		}, 3*time.Second, 10*time.Millisecond)
+	}
+
+	_, err = client(t, agents[1], creds).Produce(ctx, &log_v1.ProduceRequest{
+		Record: &log_v1.Record{Value: []byte("bar")},
+	})
+	require.Error(t, err)
+	leaderAddr, addrErr := agents[0].RPCAddr()
+	require.NoError(t, addrErr)
+	require.Contains(t, err.Error(), leaderAddr)
+
+	// clients resolving the cluster produce through the leader
+	// whichever server they dial.
+	rpcAddr, err := agents[1].RPCAddr()
+	require.NoError(t, err)
+	conn, err := grpc.Dial(
+		fmt.Sprintf("%s:///%s", loadbalance.Name, rpcAddr),
+		grpc.WithTransportCredentials(creds),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+	balanced := log_v1.NewLogClient(conn)
+
+	produce, err = balanced.Produce(ctx, &log_v1.ProduceRequest{
+		Record: &log_v1.Record{Value: []byte("bar")},
+	})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		consume, err := balanced.Consume(ctx, &log_v1.ConsumeRequest{
+			Offset: produce.Offset,
+		})
+		return err == nil && string(consume.Record.Value) == "bar"
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+func client(t *testing.T, agent *Agent, creds credentials.TransportCredentials) log_v1.LogClient {
+	t.Helper()
+	rpcAddr, err := agent.RPCAddr()
+	require.NoError(t, err)
+	conn, err := grpc.Dial(
+		rpcAddr,
+		grpc.WithTransportCredentials(creds),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return log_v1.NewLogClient(conn)
+}
+
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Wildcard matches any subject, object or action in a rule.
+const Wildcard = "*"
+
+// DefaultLog is the object naming the log served for requests without
+// a topic. It is not a valid topic name.
+const DefaultLog = "@default"
+
+type rule struct {
+	subject, object, action string
+}
+
+func (r rule) allows(subject, object, action string) bool {
+	return match(r.subject, subject) &&
+		match(r.object, object) &&
+		match(r.action, action)
+}
+
+func match(pattern, s string) bool {
+	return pattern == Wildcard || pattern == s
+}
+
+// Authorizer permits the actions listed in its policy. A policy has
+// one rule per line, made of a subject, an object and an action
+// separated by whitespace:
+//
+//	# team-a owns the orders topic, billing reads it
+//	team-a   orders  produce
+//	team-a   orders  consume
+//	billing  orders  consume
+//	admin    *       *
+//
+// Subjects are the common names of client certificates, objects are
+// topics or DefaultLog. Anything not listed is denied.
+type Authorizer struct {
+	rules []rule
+}
+
+// New loads the policy in policyFile.
+func New(policyFile string) (*Authorizer, error) {
+	f, err := os.Open(policyFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	a, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", policyFile, err)
+	}
+	return a, nil
+}
+
+// Parse reads a policy from r.
+func Parse(r io.Reader) (*Authorizer, error) {
+	a := &Authorizer{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		switch len(fields) {
+		case 0:
+			continue
+		case 3:
+			a.rules = append(a.rules, rule{
+				subject: fields[0],
+				object:  fields[1],
+				action:  fields[2],
+			})
+		default:
+			return nil, fmt.Errorf("line %d: want subject, object and action, got %q", line, scanner.Text())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Authorize returns a PermissionDenied status error unless the policy
+// permits subject to take action on object.
+func (a *Authorizer) Authorize(subject, object, action string) error {
+	for _, r := range a.rules {
+		if r.allows(subject, object, action) {
+			return nil
+		}
+	}
+	return status.Error(
+		codes.PermissionDenied,
+		fmt.Sprintf("%q not permitted to %s %s", subject, action, object),
+	)
+}
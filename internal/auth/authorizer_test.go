@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const policy = `
+# team-a owns orders, billing reads it
+team-a  orders    produce
+team-a  orders    consume
+billing orders    consume   # read only
+*       @default  consume
+admin   *         *
+`
+
+func TestAuthorize(t *testing.T) {
+	a, err := Parse(strings.NewReader(policy))
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		subject, object, action string
+		allowed                 bool
+	}{
+		{"team-a", "orders", "produce", true},
+		{"team-a", "orders", "consume", true},
+		{"billing", "orders", "consume", true},
+		{"billing", "orders", "produce", false},
+		{"team-a", "invoices", "produce", false},
+		{"billing", DefaultLog, "consume", true},
+		{"", DefaultLog, "consume", true},
+		{"billing", DefaultLog, "produce", false},
+		{"admin", "invoices", "manage", true},
+		{"", "orders", "consume", false},
+	} {
+		err := a.Authorize(tc.subject, tc.object, tc.action)
+		if tc.allowed {
+			require.NoError(t, err, "%+v", tc)
+			continue
+		}
+		require.Error(t, err, "%+v", tc)
+		require.Equal(t, codes.PermissionDenied, status.Code(err))
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	_, err := Parse(strings.NewReader("team-a orders\n"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "line 1")
+
+	// nothing is permitted by an empty policy
+	a, err := Parse(strings.NewReader(""))
+	require.NoError(t, err)
+	require.Error(t, a.Authorize("admin", "orders", "consume"))
+}
+
+func TestNew(t *testing.T) {
+	dir, err := os.MkdirTemp("", "auth-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	policyFile := filepath.Join(dir, "policy")
+	require.NoError(t, os.WriteFile(policyFile, []byte(policy), 0600))
+
+	a, err := New(policyFile)
+	require.NoError(t, err)
+	require.NoError(t, a.Authorize("team-a", "orders", "produce"))
+
+	_, err = New(filepath.Join(dir, "missing"))
+	require.Error(t, err)
+}
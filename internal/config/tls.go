@@ -0,0 +1,59 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// TLSConfig lists the files a tls.Config is loaded from.
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	CAFile   string
+	// ServerAddress is the name clients verify the server's
+	// certificate against.
+	ServerAddress string
+	// Server loads a server configuration, which requires and
+	// verifies client certificates against the CA when CAFile is set.
+	// Otherwise a client configuration verifying the server against
+	// the CA is loaded.
+	Server bool
+}
+
+// SetupTLSConfig loads the tls.Config described by cfg.
+func SetupTLSConfig(cfg TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if cfg.CertFile != "" && cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if cfg.CAFile != "" {
+		b, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		ca := x509.NewCertPool()
+		if !ca.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("failed to parse root certificate: %q", cfg.CAFile)
+		}
+
+		if cfg.Server {
+			tlsConfig.ClientCAs = ca
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		} else {
+			tlsConfig.RootCAs = ca
+		}
+		tlsConfig.ServerName = cfg.ServerAddress
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,89 @@
+package config
+
+import (
+	"crypto/tls"
+	"os"
+	"testing"
+
+	"github.com/reversearrow/distributed-computing-in-go/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetupTLSConfig(t *testing.T) {
+	dir, err := os.MkdirTemp("", "tls-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca, err := testutil.NewCA(dir)
+	require.NoError(t, err)
+	serverCert, serverKey, err := ca.Issue("server", "127.0.0.1", "localhost")
+	require.NoError(t, err)
+	clientCert, clientKey, err := ca.Issue("client")
+	require.NoError(t, err)
+
+	serverTLS, err := SetupTLSConfig(TLSConfig{
+		CertFile: serverCert,
+		KeyFile:  serverKey,
+		CAFile:   ca.CAFile,
+		Server:   true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, tls.RequireAndVerifyClientCert, serverTLS.ClientAuth)
+	require.Len(t, serverTLS.Certificates, 1)
+
+	clientTLS, err := SetupTLSConfig(TLSConfig{
+		CertFile:      clientCert,
+		KeyFile:       clientKey,
+		CAFile:        ca.CAFile,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	require.NotNil(t, clientTLS.RootCAs)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", serverTLS)
+	require.NoError(t, err)
+	defer ln.Close()
+
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			err = conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+		accepted <- err
+	}()
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), clientTLS)
+	require.NoError(t, err)
+	require.Equal(t, "server", conn.ConnectionState().PeerCertificates[0].Subject.CommonName)
+	conn.Close()
+	require.NoError(t, <-accepted)
+
+	// clients without a certificate are refused
+	anonymous, err := SetupTLSConfig(TLSConfig{
+		CAFile:        ca.CAFile,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			err = conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+		accepted <- err
+	}()
+	conn, err = tls.Dial("tcp", ln.Addr().String(), anonymous)
+	if err == nil {
+		// TLS 1.3 reports the refusal on the first read
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	require.Error(t, err)
+	require.Error(t, <-accepted)
+
+	_, err = SetupTLSConfig(TLSConfig{CAFile: serverKey})
+	require.Error(t, err)
+}
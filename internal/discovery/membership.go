@@ -0,0 +1,184 @@
+package discovery
+
+import (
+	"errors"
+	"log"
+	"net"
+
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/serf/serf"
+)
+
+// RPCAddrTag is the tag members gossip their RPC address under.
+const RPCAddrTag = "rpc_addr"
+
+// Config configures a Membership.
+type Config struct {
+	// NodeName identifies the member in the cluster.
+	NodeName string
+	// BindAddr is the address gossip is served on.
+	BindAddr string
+	// Tags are gossiped along with the member, RPCAddrTag among them.
+	Tags map[string]string
+	// StartJoinAddrs are the gossip addresses of members of the
+	// cluster to join, none starts a new cluster.
+	StartJoinAddrs []string
+	// Logger reports the failures to handle membership events,
+	// log.Default when nil.
+	Logger *log.Logger
+}
+
+// Handler is notified of the members joining and leaving the cluster.
+type Handler interface {
+	Join(name, addr string) error
+	Leave(name string) error
+}
+
+// Membership gossips with the other members of the cluster with serf
+// and tells the handler about the members that join and leave.
+type Membership struct {
+	Config
+	handler Handler
+	serf    *serf.Serf
+	events  chan serf.Event
+	// done stops the event handler, which closes stopped once it
+	// returned.
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// New joins the cluster, or starts a new one, and starts handling its
+// membership events.
+func New(handler Handler, config Config) (*Membership, error) {
+	if config.Logger == nil {
+		config.Logger = log.Default()
+	}
+
+	m := &Membership{
+		Config:  config,
+		handler: handler,
+	}
+	if err := m.setupSerf(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Membership) setupSerf() error {
+	addr, err := net.ResolveTCPAddr("tcp", m.BindAddr)
+	if err != nil {
+		return err
+	}
+
+	config := serf.DefaultConfig()
+	config.Init()
+	config.MemberlistConfig.BindAddr = addr.IP.String()
+	config.MemberlistConfig.BindPort = addr.Port
+	m.events = make(chan serf.Event)
+	m.done = make(chan struct{})
+	m.stopped = make(chan struct{})
+	config.EventCh = m.events
+	config.Tags = m.Tags
+	config.NodeName = m.NodeName
+
+	m.serf, err = serf.Create(config)
+	if err != nil {
+		return err
+	}
+
+	go m.eventHandler()
+	if m.StartJoinAddrs != nil {
+		if _, err := m.serf.Join(m.StartJoinAddrs, true); err != nil {
+			m.stop()
+			return err
+		}
+	}
+	return nil
+}
+
+// eventHandler tells the handler about the members that join and
+// leave. Members that failed are kept, they may come back and the
+// cluster keeps working without them as long as it has a quorum.
+func (m *Membership) eventHandler() {
+	defer close(m.stopped)
+	for {
+		var e serf.Event
+		select {
+		case e = <-m.events:
+		case <-m.done:
+			return
+		}
+
+		switch e.EventType() {
+		case serf.EventMemberJoin:
+			for _, member := range e.(serf.MemberEvent).Members {
+				if m.isLocal(member) {
+					continue
+				}
+				m.handleJoin(member)
+			}
+		case serf.EventMemberLeave:
+			for _, member := range e.(serf.MemberEvent).Members {
+				if m.isLocal(member) {
+					continue
+				}
+				m.handleLeave(member)
+			}
+		}
+	}
+}
+
+func (m *Membership) handleJoin(member serf.Member) {
+	if err := m.handler.Join(
+		member.Name,
+		member.Tags[RPCAddrTag],
+	); err != nil {
+		m.logError(err, "failed to join", member)
+	}
+}
+
+func (m *Membership) handleLeave(member serf.Member) {
+	if err := m.handler.Leave(member.Name); err != nil {
+		m.logError(err, "failed to leave", member)
+	}
+}
+
+func (m *Membership) isLocal(member serf.Member) bool {
+	return m.serf.LocalMember().Name == member.Name
+}
+
+// Members returns the members of the cluster as known locally.
+func (m *Membership) Members() []serf.Member {
+	return m.serf.Members()
+}
+
+// Leave tells the other members this one is leaving, stops gossiping
+// and stops handling membership events.
+func (m *Membership) Leave() error {
+	if err := m.serf.Leave(); err != nil {
+		return err
+	}
+	return m.stop()
+}
+
+// stop stops gossiping and handling membership events. serf's channel
+// is not closed as serf may still be sending on it while it shuts down.
+func (m *Membership) stop() error {
+	err := m.serf.Shutdown()
+	close(m.done)
+	<-m.stopped
+	return err
+}
+
+// logError reports a handler failure. Every member is notified of the
+// events but only the raft leader can change the cluster, so the
+// followers' refusals are expected and not reported.
+func (m *Membership) logError(err error, msg string, member serf.Member) {
+	if errors.Is(err, raft.ErrNotLeader) {
+		return
+	}
+	m.Logger.Printf(
+		"[ERROR] discovery: %s %s at %s: %v",
+		msg, member.Name, member.Tags[RPCAddrTag], err,
+	)
+}
@@ -0,0 +1,139 @@
+package discovery
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMembership(t *testing.T) {
+	m, handler := setupMember(t, nil)
+	m, _ = setupMember(t, m)
+	m, _ = setupMember(t, m)
+
+	require.Eventually(t, func() bool {
+		return len(handler.joins) == 2 &&
+			len(m[0].Members()) == 3 &&
+			len(handler.leaves) == 0
+	}, 3*time.Second, 250*time.Millisecond)
+
+	require.NoError(t, m[2].Leave())
+
+	require.Eventually(t, func() bool {
+		return len(handler.joins) == 2 &&
+			len(m[0].Members()) == 3 &&
+			status(m[0], "2") == serf.StatusLeft &&
+			len(handler.leaves) == 1
+	}, 3*time.Second, 250*time.Millisecond)
+
+	require.Equal(t, "2", <-handler.leaves)
+	// the member stopped handling events when it left
+	select {
+	case <-m[2].stopped:
+	default:
+		t.Fatal("event handler still running after leaving")
+	}
+}
+
+func TestMembershipJoinFails(t *testing.T) {
+	c := Config{
+		NodeName:       "0",
+		BindAddr:       freeAddr(t),
+		StartJoinAddrs: []string{freeAddr(t)},
+	}
+	_, err := New(&handler{}, c)
+	require.Error(t, err)
+
+	// the failed member released its address
+	c.StartJoinAddrs = nil
+	m, err := New(&handler{}, c)
+	require.NoError(t, err)
+	require.NoError(t, m.Leave())
+}
+
+func TestMembershipFailedMember(t *testing.T) {
+	m, handler := setupMember(t, nil)
+	m, _ = setupMember(t, m)
+	require.Eventually(t, func() bool {
+		return len(handler.joins) == 1 && len(m[0].Members()) == 2
+	}, 3*time.Second, 250*time.Millisecond)
+
+	// a member that stops without leaving fails, but it may come back
+	// so the handler keeps it.
+	require.NoError(t, m[1].serf.Shutdown())
+	require.Eventually(t, func() bool {
+		return status(m[0], "1") == serf.StatusFailed
+	}, 15*time.Second, 250*time.Millisecond)
+	require.Len(t, handler.leaves, 0)
+	require.NoError(t, m[0].Leave())
+}
+
+func status(m *Membership, name string) serf.MemberStatus {
+	for _, member := range m.Members() {
+		if member.Name == name {
+			return member.Status
+		}
+	}
+	return serf.StatusNone
+}
+
+func setupMember(t *testing.T, members []*Membership) ([]*Membership, *handler) {
+	id := len(members)
+	addr := freeAddr(t)
+	c := Config{
+		NodeName: fmt.Sprintf("%d", id),
+		BindAddr: addr,
+		Tags: map[string]string{
+			RPCAddrTag: addr,
+		},
+	}
+
+	h := &handler{}
+	if len(members) == 0 {
+		h.joins = make(chan map[string]string, 3)
+		h.leaves = make(chan string, 3)
+	} else {
+		c.StartJoinAddrs = []string{
+			members[0].BindAddr,
+		}
+	}
+
+	m, err := New(h, c)
+	require.NoError(t, err)
+	members = append(members, m)
+	return members, h
+}
+
+type handler struct {
+	joins  chan map[string]string
+	leaves chan string
+}
+
+func (h *handler) Join(id, addr string) error {
+	if h.joins != nil {
+		h.joins <- map[string]string{
+			"id":   id,
+			"addr": addr,
+		}
+	}
+	return nil
+}
+
+func (h *handler) Leave(id string) error {
+	if h.leaves != nil {
+		h.leaves <- id
+	}
+	return nil
+}
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	return ln.Addr().String()
+}
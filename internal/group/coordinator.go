@@ -0,0 +1,430 @@
+package group
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const defaultSessionTimeout = 10 * time.Second
+
+var (
+	ErrUnknownMember        = errors.New("group: unknown member")
+	ErrStaleGeneration      = errors.New("group: stale generation")
+	ErrInconsistentStrategy = errors.New("group: inconsistent assignment strategy")
+	ErrNoTopics             = errors.New("group: no topics to consume")
+	ErrNotAssigned          = errors.New("group: partition not assigned to the member")
+)
+
+// Strategy is how a group's partitions are spread across its members.
+type Strategy int
+
+const (
+	// StrategyRange gives every member a contiguous range of each topic's
+	// partitions.
+	StrategyRange Strategy = iota
+	// StrategyRoundRobin deals the partitions of all topics to the
+	// members one at a time.
+	StrategyRoundRobin
+)
+
+// CoordinatorConfig configures a Coordinator.
+type CoordinatorConfig struct {
+	// SessionTimeout is how long a member stays in its group without
+	// joining or heartbeating.
+	SessionTimeout time.Duration
+	// Partitions returns the number of partitions of a topic.
+	Partitions func(topic string) (uint32, error)
+	// Now returns the current time, time.Now when nil.
+	Now func() time.Time
+}
+
+func (c CoordinatorConfig) now() time.Time {
+	if c.Now == nil {
+		return time.Now()
+	}
+	return c.Now()
+}
+
+// Membership is a member's view of its group.
+type Membership struct {
+	MemberID   string
+	Generation uint64
+	Assignment []Partition
+}
+
+type member struct {
+	id       string
+	topics   []string
+	lastSeen time.Time
+}
+
+type groupState struct {
+	strategy    Strategy
+	generation  uint64
+	members     map[string]*member
+	assignments map[string][]Partition
+}
+
+// Coordinator keeps the members of the consumer groups and assigns
+// them the partitions they consume. Every change of a group's members
+// starts a new generation with a new assignment, the members learn
+// about it when their heartbeat is refused as stale and they join
+// again. Members that timed out are removed whenever their group is
+// used.
+type Coordinator struct {
+	mu sync.Mutex
+
+	Config CoordinatorConfig
+
+	groups map[string]*groupState
+	nextID uint64
+}
+
+// NewCoordinator returns a coordinator without any group.
+func NewCoordinator(c CoordinatorConfig) *Coordinator {
+	if c.SessionTimeout == 0 {
+		c.SessionTimeout = defaultSessionTimeout
+	}
+	return &Coordinator{
+		Config: c,
+		groups: make(map[string]*groupState),
+	}
+}
+
+// Join adds a member subscribed to topics to the group, or refreshes
+// it when memberID is already one of its members. A member ID is
+// assigned to new members when memberID is empty. A new generation
+// starts unless the member rejoins with the same topics.
+func (c *Coordinator) Join(group, memberID string, topics []string, strategy Strategy) (Membership, error) {
+	if group == "" {
+		return Membership{}, ErrInvalidGroup
+	}
+	if len(topics) == 0 {
+		return Membership{}, ErrNoTopics
+	}
+	topics = dedupe(topics)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, topic := range topics {
+		if _, err := c.partitions(topic); err != nil {
+			return Membership{}, err
+		}
+	}
+
+	now := c.Config.now()
+	g, ok := c.groups[group]
+	if ok {
+		c.expire(g, now)
+	}
+	if !ok || len(g.members) == 0 {
+		g = &groupState{
+			strategy:   strategy,
+			generation: generation(g),
+			members:    make(map[string]*member),
+		}
+		c.groups[group] = g
+	}
+	if g.strategy != strategy {
+		return Membership{}, fmt.Errorf("%w: %s", ErrInconsistentStrategy, group)
+	}
+
+	m, ok := g.members[memberID]
+	if memberID != "" && !ok {
+		return Membership{}, fmt.Errorf("%w: %s", ErrUnknownMember, memberID)
+	}
+	if !ok {
+		c.nextID++
+		m = &member{id: fmt.Sprintf("%s-%d", group, c.nextID)}
+		g.members[m.id] = m
+	}
+	m.lastSeen = now
+
+	if !ok || !equal(m.topics, topics) {
+		m.topics = topics
+		c.rebalance(g)
+	}
+
+	return Membership{
+		MemberID:   m.id,
+		Generation: g.generation,
+		Assignment: g.assignments[m.id],
+	}, nil
+}
+
+// Heartbeat keeps the member in its group. It fails with
+// ErrStaleGeneration once the group moved on to a new generation, the
+// member must then join again to get its new assignment.
+func (c *Coordinator) Heartbeat(group, memberID string, generation uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	m, err := c.member(group, memberID, generation)
+	if err != nil {
+		return err
+	}
+	m.lastSeen = c.Config.now()
+	return nil
+}
+
+// Leave removes the member from its group.
+func (c *Coordinator) Leave(group, memberID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	g, ok := c.groups[group]
+	if ok {
+		c.expire(g, c.Config.now())
+	}
+	if !ok || g.members[memberID] == nil {
+		return fmt.Errorf("%w: %s", ErrUnknownMember, memberID)
+	}
+
+	delete(g.members, memberID)
+	c.rebalance(g)
+	return nil
+}
+
+// Active reports whether the group has live members.
+func (c *Coordinator) Active(group string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	g, ok := c.groups[group]
+	if !ok {
+		return false
+	}
+	c.expire(g, c.Config.now())
+	return len(g.members) > 0
+}
+
+// Topics returns the topics the member of the group consumes.
+func (c *Coordinator) Topics(group, memberID string) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	g, ok := c.groups[group]
+	if ok {
+		c.expire(g, c.Config.now())
+	}
+	if !ok || g.members[memberID] == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownMember, memberID)
+	}
+	return append([]string(nil), g.members[memberID].topics...), nil
+}
+
+// Validate checks that the member belongs to the group's current
+// generation, fencing members that missed a rebalance.
+func (c *Coordinator) Validate(group, memberID string, generation uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, err := c.member(group, memberID, generation)
+	return err
+}
+
+// Owns checks that the partition is assigned to the member in the
+// group's current generation, so that no two members consume it.
+func (c *Coordinator) Owns(group, memberID string, generation uint64, topic string, partition uint32) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, err := c.member(group, memberID, generation); err != nil {
+		return err
+	}
+	for _, p := range c.groups[group].assignments[memberID] {
+		if p.Topic == topic && p.Partition == partition {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s/%d, member %s", ErrNotAssigned, topic, partition, memberID)
+}
+
+// member returns a live member of the group's current generation. It
+// must be called with c.mu held.
+func (c *Coordinator) member(group, memberID string, generation uint64) (*member, error) {
+	g, ok := c.groups[group]
+	if ok {
+		c.expire(g, c.Config.now())
+	}
+	if !ok || g.members[memberID] == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownMember, memberID)
+	}
+	if generation != g.generation {
+		return nil, fmt.Errorf(
+			"%w: %d, group %s is at generation %d",
+			ErrStaleGeneration, generation, group, g.generation,
+		)
+	}
+	return g.members[memberID], nil
+}
+
+// expire removes the members that timed out and rebalances the group
+// when there were any.
+func (c *Coordinator) expire(g *groupState, now time.Time) {
+	deadline := now.Add(-c.Config.SessionTimeout)
+
+	var expired bool
+	for id, m := range g.members {
+		if m.lastSeen.Before(deadline) {
+			delete(g.members, id)
+			expired = true
+		}
+	}
+	if expired {
+		c.rebalance(g)
+	}
+}
+
+// rebalance starts a new generation and assigns the partitions of the
+// subscribed topics to the members. Topics deleted since they were
+// subscribed to have no partitions.
+func (c *Coordinator) rebalance(g *groupState) {
+	members := make([]*member, 0, len(g.members))
+	for _, m := range g.members {
+		members = append(members, m)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].id < members[j].id
+	})
+
+	partitions := make(map[string]uint32)
+	for _, m := range members {
+		for _, topic := range m.topics {
+			if _, ok := partitions[topic]; ok {
+				continue
+			}
+			n, _ := c.partitions(topic)
+			partitions[topic] = n
+		}
+	}
+
+	g.generation++
+	switch g.strategy {
+	case StrategyRoundRobin:
+		g.assignments = assignRoundRobin(members, partitions)
+	default:
+		g.assignments = assignRange(members, partitions)
+	}
+}
+
+func (c *Coordinator) partitions(topic string) (uint32, error) {
+	if c.Config.Partitions == nil {
+		return 1, nil
+	}
+	return c.Config.Partitions(topic)
+}
+
+// assignRange splits every topic's partitions in contiguous ranges, one
+// per subscribed member. The first members get one more partition when
+// they do not divide evenly.
+func assignRange(members []*member, partitions map[string]uint32) map[string][]Partition {
+	assignments := make(map[string][]Partition)
+	for _, topic := range sortedTopics(partitions) {
+		subscribed := subscribers(members, topic)
+		if len(subscribed) == 0 {
+			continue
+		}
+
+		n := partitions[topic]
+		size, extra := n/uint32(len(subscribed)), n%uint32(len(subscribed))
+		var p uint32
+		for i, m := range subscribed {
+			count := size
+			if uint32(i) < extra {
+				count++
+			}
+			for end := p + count; p < end; p++ {
+				assignments[m.id] = append(assignments[m.id], Partition{Topic: topic, Partition: p})
+			}
+		}
+	}
+	return assignments
+}
+
+// assignRoundRobin deals the partitions of all topics, in order, to the
+// members subscribed to them.
+func assignRoundRobin(members []*member, partitions map[string]uint32) map[string][]Partition {
+	assignments := make(map[string][]Partition)
+	var next int
+	for _, topic := range sortedTopics(partitions) {
+		for p := uint32(0); p < partitions[topic]; p++ {
+			for i := 0; i < len(members); i++ {
+				m := members[(next+i)%len(members)]
+				if !contains(m.topics, topic) {
+					continue
+				}
+				assignments[m.id] = append(assignments[m.id], Partition{Topic: topic, Partition: p})
+				next = (next + i + 1) % len(members)
+				break
+			}
+		}
+	}
+	return assignments
+}
+
+func subscribers(members []*member, topic string) []*member {
+	var subscribed []*member
+	for _, m := range members {
+		if contains(m.topics, topic) {
+			subscribed = append(subscribed, m)
+		}
+	}
+	return subscribed
+}
+
+func sortedTopics(partitions map[string]uint32) []string {
+	topics := make([]string, 0, len(partitions))
+	for topic := range partitions {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// generation returns the generation of a group being restarted, so a
+// member of its previous life is still fenced.
+func generation(g *groupState) uint64 {
+	if g == nil {
+		return 0
+	}
+	return g.generation
+}
+
+func dedupe(topics []string) []string {
+	sorted := append([]string(nil), topics...)
+	sort.Strings(sorted)
+
+	out := sorted[:0]
+	for i, topic := range sorted {
+		if i == 0 || topic != sorted[i-1] {
+			out = append(out, topic)
+		}
+	}
+	return out
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(topics []string, topic string) bool {
+	for _, t := range topics {
+		if t == topic {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package group
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var errUnknownTopic = errors.New("unknown topic")
+
+func testCoordinator(now *time.Time) *Coordinator {
+	partitions := map[string]uint32{"orders": 5, "payments": 2}
+	return NewCoordinator(CoordinatorConfig{
+		SessionTimeout: time.Second,
+		Partitions: func(topic string) (uint32, error) {
+			n, ok := partitions[topic]
+			if !ok {
+				return 0, errUnknownTopic
+			}
+			return n, nil
+		},
+		Now: func() time.Time { return *now },
+	})
+}
+
+func TestCoordinatorRange(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := testCoordinator(&now)
+
+	a, err := c.Join("billing", "", []string{"orders", "payments"}, StrategyRange)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), a.Generation)
+	require.Len(t, a.Assignment, 7)
+
+	b, err := c.Join("billing", "", []string{"orders", "payments"}, StrategyRange)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), b.Generation)
+	require.Equal(t, []Partition{
+		{"orders", 3}, {"orders", 4}, {"payments", 1},
+	}, b.Assignment)
+
+	// a is fenced until it joins again
+	require.ErrorIs(t, c.Heartbeat("billing", a.MemberID, a.Generation), ErrStaleGeneration)
+	require.ErrorIs(t, c.Validate("billing", a.MemberID, a.Generation), ErrStaleGeneration)
+
+	a, err = c.Join("billing", a.MemberID, []string{"payments", "orders"}, StrategyRange)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), a.Generation)
+	require.Equal(t, []Partition{
+		{"orders", 0}, {"orders", 1}, {"orders", 2}, {"payments", 0},
+	}, a.Assignment)
+	require.NoError(t, c.Heartbeat("billing", a.MemberID, a.Generation))
+	require.NoError(t, c.Owns("billing", a.MemberID, a.Generation, "orders", 2))
+	require.ErrorIs(t, c.Owns("billing", a.MemberID, a.Generation, "orders", 3), ErrNotAssigned)
+	require.ErrorIs(t, c.Owns("billing", b.MemberID, b.Generation-1, "orders", 3), ErrStaleGeneration)
+	topics, err := c.Topics("billing", a.MemberID)
+	require.NoError(t, err)
+	require.Equal(t, []string{"orders", "payments"}, topics)
+	_, err = c.Topics("billing", "gone")
+	require.ErrorIs(t, err, ErrUnknownMember)
+
+	_, err = c.Join("billing", "", []string{"orders"}, StrategyRoundRobin)
+	require.ErrorIs(t, err, ErrInconsistentStrategy)
+	_, err = c.Join("billing", "", []string{"unknown"}, StrategyRange)
+	require.ErrorIs(t, err, errUnknownTopic)
+	_, err = c.Join("billing", "gone", []string{"orders"}, StrategyRange)
+	require.ErrorIs(t, err, ErrUnknownMember)
+
+	require.NoError(t, c.Leave("billing", b.MemberID))
+	require.ErrorIs(t, c.Leave("billing", b.MemberID), ErrUnknownMember)
+
+	a, err = c.Join("billing", a.MemberID, []string{"orders", "payments"}, StrategyRange)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), a.Generation)
+	require.Len(t, a.Assignment, 7)
+}
+
+func TestCoordinatorRoundRobin(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := testCoordinator(&now)
+
+	a, err := c.Join("billing", "", []string{"orders", "payments"}, StrategyRoundRobin)
+	require.NoError(t, err)
+	b, err := c.Join("billing", "", []string{"orders"}, StrategyRoundRobin)
+	require.NoError(t, err)
+	a, err = c.Join("billing", a.MemberID, []string{"orders", "payments"}, StrategyRoundRobin)
+	require.NoError(t, err)
+
+	require.Equal(t, []Partition{
+		{"orders", 0}, {"orders", 2}, {"orders", 4},
+		{"payments", 0}, {"payments", 1},
+	}, a.Assignment)
+	require.Equal(t, []Partition{
+		{"orders", 1}, {"orders", 3},
+	}, b.Assignment)
+}
+
+func TestCoordinatorSessionTimeout(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := testCoordinator(&now)
+
+	a, err := c.Join("billing", "", []string{"orders"}, StrategyRange)
+	require.NoError(t, err)
+	b, err := c.Join("billing", "", []string{"orders"}, StrategyRange)
+	require.NoError(t, err)
+
+	now = now.Add(700 * time.Millisecond)
+	require.NoError(t, c.Heartbeat("billing", b.MemberID, b.Generation))
+
+	// a missed its session, b takes over every partition
+	now = now.Add(700 * time.Millisecond)
+	require.ErrorIs(t, c.Heartbeat("billing", b.MemberID, b.Generation), ErrStaleGeneration)
+	require.ErrorIs(t, c.Heartbeat("billing", a.MemberID, a.Generation), ErrUnknownMember)
+
+	b, err = c.Join("billing", b.MemberID, []string{"orders"}, StrategyRange)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), b.Generation)
+	require.Len(t, b.Assignment, 5)
+
+	// a group left empty keeps counting generations
+	require.True(t, c.Active("billing"))
+	now = now.Add(2 * time.Second)
+	require.False(t, c.Active("billing"))
+	require.False(t, c.Active("unknown"))
+	a, err = c.Join("billing", "", []string{"orders"}, StrategyRoundRobin)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), a.Generation)
+}
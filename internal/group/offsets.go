@@ -0,0 +1,178 @@
+package group
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	log_v1 "github.com/reversearrow/distributed-computing-in-go/api/v1"
+	"github.com/reversearrow/distributed-computing-in-go/internal/log"
+)
+
+// OffsetsLog is the name of the internal log committed offsets are
+// stored in.
+const OffsetsLog = "__consumer_offsets"
+
+const offsetWidth = 8
+
+var (
+	ErrNoCommittedOffset = errors.New("group: no committed offset")
+	ErrInvalidGroup      = errors.New("group: invalid group name")
+
+	enc = binary.BigEndian
+)
+
+// Partition identifies the partition of a topic a group consumes. The
+// empty topic is the server's default log.
+type Partition struct {
+	Topic     string
+	Partition uint32
+}
+
+type offsetKey struct {
+	group     string
+	partition Partition
+}
+
+// Offsets keeps the offsets committed by consumer groups. Every commit
+// is appended to an internal compacted log keyed by group, topic and
+// partition, and the latest offsets are kept in memory. The log is
+// replayed when Offsets is opened.
+type Offsets struct {
+	mu sync.RWMutex
+
+	log     *log.Log
+	offsets map[offsetKey]uint64
+}
+
+// NewOffsets opens the offsets log in dir. Compaction is always
+// enabled, only the latest commit of every key is needed.
+func NewOffsets(dir string, c log.Config) (*Offsets, error) {
+	c.Compaction.Enabled = true
+
+	l, err := log.NewLog(dir, c)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &Offsets{
+		log:     l,
+		offsets: make(map[offsetKey]uint64),
+	}
+	if err := o.replay(); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("replaying %s: %w", OffsetsLog, err)
+	}
+	return o, nil
+}
+
+func (o *Offsets) replay() error {
+	off, err := o.log.LowestOffset()
+	if err != nil {
+		return err
+	}
+
+	for {
+		record, err := o.log.Read(off)
+		if errors.As(err, &log.ErrOffSetOutOfRange{}) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		off = record.Offset + 1
+
+		key, err := decodeKey(record.Key)
+		if err != nil {
+			return fmt.Errorf("record %d: %w", record.Offset, err)
+		}
+		if len(record.Value) != offsetWidth {
+			return fmt.Errorf("record %d: invalid offset of %d bytes", record.Offset, len(record.Value))
+		}
+		o.offsets[key] = enc.Uint64(record.Value)
+	}
+}
+
+// Commit durably records offset as the next offset the group consumes
+// from the partition.
+func (o *Offsets) Commit(group string, p Partition, offset uint64) error {
+	if group == "" {
+		return ErrInvalidGroup
+	}
+
+	key := offsetKey{group: group, partition: p}
+	value := make([]byte, offsetWidth)
+	enc.PutUint64(value, offset)
+
+	// the lock keeps the log and the map in the same order
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if _, err := o.log.Append(&log_v1.Record{
+		Key:   encodeKey(key),
+		Value: value,
+	}); err != nil {
+		return err
+	}
+	o.offsets[key] = offset
+	return nil
+}
+
+// Fetch returns the offset committed by the group for the partition.
+func (o *Offsets) Fetch(group string, p Partition) (uint64, error) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	offset, ok := o.offsets[offsetKey{group: group, partition: p}]
+	if !ok {
+		return 0, fmt.Errorf("%w: %s %s/%d", ErrNoCommittedOffset, group, p.Topic, p.Partition)
+	}
+	return offset, nil
+}
+
+// Close closes the offsets log.
+func (o *Offsets) Close() error {
+	return o.log.Close()
+}
+
+// encodeKey encodes the key as the length prefixed group and topic
+// followed by the partition.
+func encodeKey(k offsetKey) []byte {
+	p := k.partition
+	b := make([]byte, 2*binary.MaxVarintLen64+len(k.group)+len(p.Topic)+4)
+	n := binary.PutUvarint(b, uint64(len(k.group)))
+	n += copy(b[n:], k.group)
+	n += binary.PutUvarint(b[n:], uint64(len(p.Topic)))
+	n += copy(b[n:], p.Topic)
+	enc.PutUint32(b[n:], p.Partition)
+	return b[:n+4]
+}
+
+func decodeKey(b []byte) (offsetKey, error) {
+	var k offsetKey
+	group, b, err := decodeString(b)
+	if err != nil {
+		return k, err
+	}
+	topic, b, err := decodeString(b)
+	if err != nil {
+		return k, err
+	}
+	if len(b) != 4 {
+		return k, errors.New("invalid key")
+	}
+
+	k.group = group
+	k.partition = Partition{Topic: topic, Partition: enc.Uint32(b)}
+	return k, nil
+}
+
+func decodeString(b []byte) (string, []byte, error) {
+	n, w := binary.Uvarint(b)
+	if w <= 0 || uint64(len(b)-w) < n {
+		return "", nil, errors.New("invalid key")
+	}
+	b = b[w:]
+	return string(b[:n]), b[n:], nil
+}
@@ -0,0 +1,73 @@
+package group
+
+import (
+	"os"
+	"testing"
+
+	"github.com/reversearrow/distributed-computing-in-go/internal/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOffsets(t *testing.T) {
+	dir, err := os.MkdirTemp("", "offsets-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 128
+
+	o, err := NewOffsets(dir, c)
+	require.NoError(t, err)
+
+	orders := Partition{Topic: "orders", Partition: 1}
+	_, err = o.Fetch("billing", orders)
+	require.ErrorIs(t, err, ErrNoCommittedOffset)
+	require.ErrorIs(t, o.Commit("", orders, 1), ErrInvalidGroup)
+
+	for off := uint64(1); off <= 10; off++ {
+		require.NoError(t, o.Commit("billing", orders, off))
+	}
+	require.NoError(t, o.Commit("shipping", orders, 3))
+	require.NoError(t, o.Commit("billing", Partition{}, 7))
+
+	off, err := o.Fetch("billing", orders)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), off)
+
+	// commits of a key made redundant are compacted away, the offsets
+	// must survive it and a restart.
+	_, err = o.log.Compact()
+	require.NoError(t, err)
+	require.NoError(t, o.Close())
+
+	o, err = NewOffsets(dir, c)
+	require.NoError(t, err)
+	defer o.Close()
+
+	for _, want := range []struct {
+		group     string
+		partition Partition
+		offset    uint64
+	}{
+		{"billing", orders, 10},
+		{"shipping", orders, 3},
+		{"billing", Partition{}, 7},
+	} {
+		off, err := o.Fetch(want.group, want.partition)
+		require.NoError(t, err)
+		require.Equal(t, want.offset, off)
+	}
+
+	_, err = o.Fetch("shipping", Partition{Topic: "orders"})
+	require.ErrorIs(t, err, ErrNoCommittedOffset)
+}
+
+func TestOffsetKey(t *testing.T) {
+	k := offsetKey{group: "g", partition: Partition{Topic: "t", Partition: 1 << 20}}
+	got, err := decodeKey(encodeKey(k))
+	require.NoError(t, err)
+	require.Equal(t, k, got)
+
+	_, err = decodeKey([]byte{5, 'a'})
+	require.Error(t, err)
+}
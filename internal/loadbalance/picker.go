@@ -0,0 +1,62 @@
+package loadbalance
+
+import (
+	"strings"
+	"sync/atomic"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+)
+
+func init() {
+	balancer.Register(
+		base.NewBalancerBuilder(Name, &Picker{}, base.Config{}),
+	)
+}
+
+var (
+	_ base.PickerBuilder = (*Picker)(nil)
+	_ balancer.Picker    = (*Picker)(nil)
+)
+
+// Picker routes the calls consuming the log to the followers, in turn,
+// and every other call, producing ones first, to the leader. Consuming
+// calls go to the leader when there is no follower.
+type Picker struct {
+	leader    balancer.SubConn
+	followers []balancer.SubConn
+	current   uint64
+}
+
+// Build returns a picker over the connections that are ready.
+func (p *Picker) Build(buildInfo base.PickerBuildInfo) balancer.Picker {
+	picker := &Picker{}
+	for sc, scInfo := range buildInfo.ReadySCs {
+		isLeader, _ := scInfo.Address.Attributes.Value(isLeaderAttr).(bool)
+		if isLeader {
+			picker.leader = sc
+			continue
+		}
+		picker.followers = append(picker.followers, sc)
+	}
+	return picker
+}
+
+func (p *Picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	var result balancer.PickResult
+	if strings.Contains(info.FullMethodName, "Consume") && len(p.followers) > 0 {
+		result.SubConn = p.nextFollower()
+	} else {
+		result.SubConn = p.leader
+	}
+
+	if result.SubConn == nil {
+		return result, balancer.ErrNoSubConnAvailable
+	}
+	return result, nil
+}
+
+func (p *Picker) nextFollower() balancer.SubConn {
+	cur := atomic.AddUint64(&p.current, 1)
+	return p.followers[cur%uint64(len(p.followers))]
+}
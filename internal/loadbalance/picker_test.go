@@ -0,0 +1,97 @@
+package loadbalance
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+)
+
+func TestPickerNoSubConnAvailable(t *testing.T) {
+	picker := &Picker{}
+	for _, method := range []string{
+		"/log.v1.Log/Produce",
+		"/log.v1.Log/Consume",
+	} {
+		info := balancer.PickInfo{FullMethodName: method}
+		result, err := picker.Pick(info)
+		require.Equal(t, balancer.ErrNoSubConnAvailable, err)
+		require.Nil(t, result.SubConn)
+	}
+}
+
+func TestPickerProducesToLeader(t *testing.T) {
+	picker, subConns := setupTest()
+	for _, method := range []string{
+		"/log.v1.Log/Produce",
+		"/log.v1.Log/ProduceBatch",
+		"/log.v1.Log/CreateTopic",
+	} {
+		info := balancer.PickInfo{FullMethodName: method}
+		result, err := picker.Pick(info)
+		require.NoError(t, err)
+		require.Same(t, subConns[0], result.SubConn)
+	}
+}
+
+func TestPickerConsumesFromFollowers(t *testing.T) {
+	picker, subConns := setupTest()
+	info := balancer.PickInfo{FullMethodName: "/log.v1.Log/Consume"}
+
+	seen := make(map[balancer.SubConn]int)
+	for i := 0; i < 4; i++ {
+		result, err := picker.Pick(info)
+		require.NoError(t, err)
+		require.NotSame(t, subConns[0], result.SubConn)
+		seen[result.SubConn]++
+	}
+	// followers take turns
+	require.Equal(t, map[balancer.SubConn]int{subConns[1]: 2, subConns[2]: 2}, seen)
+}
+
+func TestPickerConsumesFromLeaderAlone(t *testing.T) {
+	sc := &subConn{}
+	picker := (&Picker{}).Build(base.PickerBuildInfo{
+		ReadySCs: map[balancer.SubConn]base.SubConnInfo{
+			sc: {Address: resolver.Address{
+				Attributes: attributes.New(isLeaderAttr, true),
+			}},
+		},
+	})
+
+	result, err := picker.Pick(balancer.PickInfo{FullMethodName: "/log.v1.Log/ConsumeStream"})
+	require.NoError(t, err)
+	require.Same(t, sc, result.SubConn)
+}
+
+func setupTest() (balancer.Picker, []*subConn) {
+	var subConns []*subConn
+	buildInfo := base.PickerBuildInfo{
+		ReadySCs: make(map[balancer.SubConn]base.SubConnInfo),
+	}
+	for i := 0; i < 3; i++ {
+		sc := &subConn{}
+		addr := resolver.Address{
+			Attributes: attributes.New(isLeaderAttr, i == 0),
+		}
+		sc.UpdateAddresses([]resolver.Address{addr})
+		buildInfo.ReadySCs[sc] = base.SubConnInfo{Address: addr}
+		subConns = append(subConns, sc)
+	}
+	return (&Picker{}).Build(buildInfo), subConns
+}
+
+// subConn implements balancer.SubConn.
+type subConn struct {
+	balancer.SubConn
+	addrs []resolver.Address
+}
+
+func (s *subConn) UpdateAddresses(addrs []resolver.Address) {
+	s.addrs = addrs
+}
+
+func (s *subConn) Connect() {}
@@ -0,0 +1,164 @@
+package loadbalance
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	log_v1 "github.com/reversearrow/distributed-computing-in-go/api/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// Name is the scheme of the resolver and the name of the balancer.
+// Clients dial "log:///<addr>" with addr any server of the cluster.
+const Name = "log"
+
+const (
+	// isLeaderAttr is the address attribute telling whether the
+	// server is the leader.
+	isLeaderAttr = "is_leader"
+
+	// refreshInterval is how often the servers are resolved again,
+	// so a new leader is found even when the old one is still up.
+	refreshInterval = 5 * time.Second
+
+	// resolveTimeout bounds how long resolving waits for the servers,
+	// so a server that stopped responding does not hold it up.
+	resolveTimeout = 5 * time.Second
+)
+
+func init() {
+	resolver.Register(&Resolver{})
+}
+
+var (
+	_ resolver.Builder  = (*Resolver)(nil)
+	_ resolver.Resolver = (*Resolver)(nil)
+)
+
+// Resolver resolves the servers of the cluster by asking the server
+// dialed for them with GetServers, when gRPC asks for it and every
+// refreshInterval. A server listing none is not part of a cluster and
+// is resolved to itself, as the leader.
+type Resolver struct {
+	mu            sync.Mutex
+	target        string
+	clientConn    resolver.ClientConn
+	resolverConn  *grpc.ClientConn
+	serviceConfig *serviceconfig.ParseResult
+	logger        *log.Logger
+
+	// ctx is canceled by Close, ending the resolution in flight.
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// Build returns a resolver for the cluster the target is a server of.
+func (r *Resolver) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	res := &Resolver{
+		target:     target.Endpoint(),
+		clientConn: cc,
+		logger:     log.Default(),
+	}
+	res.ctx, res.cancel = context.WithCancel(context.Background())
+
+	creds := opts.DialCreds
+	if creds == nil {
+		creds = insecure.NewCredentials()
+	}
+
+	res.serviceConfig = cc.ParseServiceConfig(
+		fmt.Sprintf(`{"loadBalancingConfig":[{"%s":{}}]}`, Name),
+	)
+
+	var err error
+	res.resolverConn, err = grpc.Dial(
+		res.target,
+		grpc.WithTransportCredentials(creds),
+	)
+	if err != nil {
+		res.cancel()
+		return nil, err
+	}
+
+	res.ResolveNow(resolver.ResolveNowOptions{})
+
+	res.wg.Add(1)
+	go res.refresh()
+	return res, nil
+}
+
+func (r *Resolver) refresh() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+			r.ResolveNow(resolver.ResolveNowOptions{})
+		}
+	}
+}
+
+func (r *Resolver) Scheme() string {
+	return Name
+}
+
+// ResolveNow updates the client connection with the servers of the
+// cluster, each tagged with whether it is the leader.
+func (r *Resolver) ResolveNow(resolver.ResolveNowOptions) {
+	ctx, cancel := context.WithTimeout(r.ctx, resolveTimeout)
+	defer cancel()
+
+	client := log_v1.NewLogClient(r.resolverConn)
+	res, err := client.GetServers(ctx, &log_v1.GetServersRequest{})
+
+	// the lock is only taken once the servers are known, a resolution
+	// waiting for them holds up neither the others nor Close.
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		r.logger.Printf("[ERROR] loadbalance: failed to resolve servers: %v", err)
+		r.clientConn.ReportError(err)
+		return
+	}
+
+	servers := res.Servers
+	if len(servers) == 0 {
+		servers = []*log_v1.Server{{RpcAddr: r.target, IsLeader: true}}
+	}
+
+	var addrs []resolver.Address
+	for _, server := range servers {
+		addrs = append(addrs, resolver.Address{
+			Addr:       server.RpcAddr,
+			Attributes: attributes.New(isLeaderAttr, server.IsLeader),
+		})
+	}
+
+	if err := r.clientConn.UpdateState(resolver.State{
+		Addresses:     addrs,
+		ServiceConfig: r.serviceConfig,
+	}); err != nil {
+		r.logger.Printf("[ERROR] loadbalance: failed to update state: %v", err)
+	}
+}
+
+func (r *Resolver) Close() {
+	r.cancel()
+	r.wg.Wait()
+
+	if err := r.resolverConn.Close(); err != nil {
+		r.logger.Printf("[ERROR] loadbalance: failed to close conn: %v", err)
+	}
+}
@@ -0,0 +1,164 @@
+package loadbalance
+
+import (
+	"net"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	log_v1 "github.com/reversearrow/distributed-computing-in-go/api/v1"
+	"github.com/reversearrow/distributed-computing-in-go/internal/server"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+func TestResolver(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv, err := server.NewGRPCServer(&server.Config{
+		GetServerer: &getServers{},
+	})
+	require.NoError(t, err)
+	go srv.Serve(ln)
+	defer srv.Stop()
+
+	conn := &clientConn{}
+	r := &Resolver{}
+	target := resolver.Target{URL: url.URL{
+		Scheme: Name,
+		Path:   "/" + ln.Addr().String(),
+	}}
+	res, err := r.Build(target, conn, resolver.BuildOptions{})
+	require.NoError(t, err)
+	defer res.Close()
+
+	require.Equal(t, resolver.State{
+		Addresses: []resolver.Address{{
+			Addr:       "localhost:9001",
+			Attributes: attributes.New(isLeaderAttr, true),
+		}, {
+			Addr:       "localhost:9002",
+			Attributes: attributes.New(isLeaderAttr, false),
+		}},
+	}, resolver.State{Addresses: conn.state.Addresses})
+	require.NotNil(t, conn.state.ServiceConfig)
+}
+
+func TestResolverStandalone(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	// a server without a cluster lists no servers
+	srv, err := server.NewGRPCServer(&server.Config{})
+	require.NoError(t, err)
+	go srv.Serve(ln)
+	defer srv.Stop()
+
+	conn := &clientConn{}
+	r := &Resolver{}
+	target := resolver.Target{URL: url.URL{
+		Scheme: Name,
+		Path:   "/" + ln.Addr().String(),
+	}}
+	res, err := r.Build(target, conn, resolver.BuildOptions{})
+	require.NoError(t, err)
+	defer res.Close()
+
+	require.Equal(t, []resolver.Address{{
+		Addr:       ln.Addr().String(),
+		Attributes: attributes.New(isLeaderAttr, true),
+	}}, conn.state.Addresses)
+}
+
+func TestResolverUnresponsiveServer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	getter := &blockingGetServers{release: make(chan struct{})}
+	srv, err := server.NewGRPCServer(&server.Config{GetServerer: getter})
+	require.NoError(t, err)
+	go srv.Serve(ln)
+	defer srv.Stop()
+	defer close(getter.release)
+
+	conn := &clientConn{}
+	r := &Resolver{}
+	target := resolver.Target{URL: url.URL{
+		Scheme: Name,
+		Path:   "/" + ln.Addr().String(),
+	}}
+	res, err := r.Build(target, conn, resolver.BuildOptions{})
+	require.NoError(t, err)
+
+	// the server stops responding, closing ends the resolution
+	// waiting for it
+	atomic.StoreInt32(&getter.block, 1)
+	resolved := make(chan struct{})
+	go func() {
+		res.ResolveNow(resolver.ResolveNowOptions{})
+		close(resolved)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		res.Close()
+		close(closed)
+	}()
+	for _, done := range []chan struct{}{closed, resolved} {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("resolver held up by an unresponsive server")
+		}
+	}
+}
+
+// blockingGetServers lists the servers until block is set, from then
+// on it waits for release.
+type blockingGetServers struct {
+	getServers
+	block   int32
+	release chan struct{}
+}
+
+func (s *blockingGetServers) GetServers() ([]*log_v1.Server, error) {
+	if atomic.LoadInt32(&s.block) == 1 {
+		<-s.release
+	}
+	return s.getServers.GetServers()
+}
+
+type getServers struct{}
+
+func (s *getServers) GetServers() ([]*log_v1.Server, error) {
+	return []*log_v1.Server{{
+		Id:       "leader",
+		RpcAddr:  "localhost:9001",
+		IsLeader: true,
+	}, {
+		Id:      "follower",
+		RpcAddr: "localhost:9002",
+	}}, nil
+}
+
+// clientConn implements resolver.ClientConn.
+type clientConn struct {
+	resolver.ClientConn
+	state resolver.State
+}
+
+func (c *clientConn) UpdateState(state resolver.State) error {
+	c.state = state
+	return nil
+}
+
+func (c *clientConn) ReportError(err error) {}
+
+func (c *clientConn) ParseServiceConfig(config string) *serviceconfig.ParseResult {
+	return &serviceconfig.ParseResult{}
+}
@@ -0,0 +1,245 @@
+package log
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	log_v1 "github.com/reversearrow/distributed-computing-in-go/api/v1"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec identifies how a batch of records is compressed on disk.
+// Its value is persisted in front of every batch, so existing values
+// must never change. Values stay below 8, a byte no marshalled record
+// starts with, which tells batches apart from the single records
+// stores held before batches were introduced.
+type Codec byte
+
+const (
+	CodecNone Codec = iota
+	CodecGzip
+	CodecSnappy
+	CodecZstd
+	CodecLZ4
+)
+
+const (
+	// codecWidth is the width of the codec byte written in front of
+	// every batch.
+	codecWidth = 1
+
+	// batchRecordsField is the protobuf field number records are
+	// written under in a batch.
+	batchRecordsField = 1
+
+	// batchIndexField is the protobuf field number a replicated log
+	// writes the raft index of the entry that appended a batch under.
+	batchIndexField = 2
+
+	// maxCodec is the first byte that cannot be a codec. Protobuf
+	// tags start at field number 1, so a marshalled record never
+	// starts with a byte below it.
+	maxCodec = 1 << 3
+
+	// stampWidth bounds the bytes the offset and append time add to a
+	// marshalled record when it is appended.
+	stampWidth = 32
+)
+
+var (
+	// zstd encoders and decoders are safe for concurrent use through
+	// EncodeAll and DecodeAll.
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+func (c Codec) String() string {
+	switch c {
+	case CodecNone:
+		return "none"
+	case CodecGzip:
+		return "gzip"
+	case CodecSnappy:
+		return "snappy"
+	case CodecZstd:
+		return "zstd"
+	case CodecLZ4:
+		return "lz4"
+	default:
+		return fmt.Sprintf("codec(%d)", byte(c))
+	}
+}
+
+// encodeBatch marshals the records into a batch compressed with the
+// codec. The batch is laid out as a protobuf message holding the records
+// as repeated field 1, so it reads like a repeated Record message, and
+// the raft index as field 2 unless it is 0.
+func encodeBatch(records []*log_v1.Record, c Codec, index uint64) ([]byte, error) {
+	var b []byte
+	for _, record := range records {
+		p, err := proto.Marshal(record)
+		if err != nil {
+			return nil, fmt.Errorf("error marshalling record: %w", err)
+		}
+		b = protowire.AppendTag(b, batchRecordsField, protowire.BytesType)
+		b = protowire.AppendBytes(b, p)
+	}
+	if index != 0 {
+		b = protowire.AppendTag(b, batchIndexField, protowire.VarintType)
+		b = protowire.AppendVarint(b, index)
+	}
+
+	p, err := compress(b, c)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{byte(c)}, p...), nil
+}
+
+// frameCodec returns the codec of a frame, legacy frames holding a
+// single record are not compressed.
+func frameCodec(p []byte) Codec {
+	if isLegacy(p) {
+		return CodecNone
+	}
+	return Codec(p[0])
+}
+
+// isLegacy reports whether the frame holds a single marshalled record
+// rather than a batch.
+func isLegacy(p []byte) bool {
+	return len(p) < codecWidth || p[0] >= maxCodec
+}
+
+// decodeBatch decompresses a batch written by encodeBatch and returns
+// its marshalled records. Legacy frames are returned as a batch of
+// their one record.
+func decodeBatch(p []byte) ([][]byte, error) {
+	records, _, err := parseBatch(p)
+	return records, err
+}
+
+// batchIndex returns the raft index written with a batch, 0 when there
+// is none.
+func batchIndex(p []byte) (uint64, error) {
+	_, index, err := parseBatch(p)
+	return index, err
+}
+
+// parseBatch decompresses a batch written by encodeBatch and returns its
+// marshalled records and raft index.
+func parseBatch(p []byte) (records [][]byte, index uint64, err error) {
+	if isLegacy(p) {
+		return [][]byte{p}, 0, nil
+	}
+
+	b, err := decompress(p[codecWidth:], Codec(p[0]))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, 0, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		switch {
+		case num == batchRecordsField && typ == protowire.BytesType:
+			record, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, 0, protowire.ParseError(n)
+			}
+			b = b[n:]
+			records = append(records, record)
+		case num == batchIndexField && typ == protowire.VarintType:
+			index, n = protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, 0, protowire.ParseError(n)
+			}
+			b = b[n:]
+		default:
+			return nil, 0, fmt.Errorf("unexpected field %d in batch", num)
+		}
+	}
+	return records, index, nil
+}
+
+// unmarshalBatch decodes a batch written by encodeBatch into records.
+func unmarshalBatch(p []byte) ([]*log_v1.Record, error) {
+	b, err := decodeBatch(p)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]*log_v1.Record, len(b))
+	for i := range b {
+		records[i] = &log_v1.Record{}
+		if err := proto.Unmarshal(b[i], records[i]); err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+func compress(p []byte, c Codec) ([]byte, error) {
+	switch c {
+	case CodecNone:
+		return p, nil
+	case CodecGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(p); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CodecSnappy:
+		return snappy.Encode(nil, p), nil
+	case CodecZstd:
+		return zstdEncoder.EncodeAll(p, nil), nil
+	case CodecLZ4:
+		var buf bytes.Buffer
+		w := lz4.NewWriter(&buf)
+		if _, err := w.Write(p); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("unknown codec %s", c)
+	}
+}
+
+func decompress(p []byte, c Codec) ([]byte, error) {
+	switch c {
+	case CodecNone:
+		return p, nil
+	case CodecGzip:
+		r, err := gzip.NewReader(bytes.NewReader(p))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	case CodecSnappy:
+		return snappy.Decode(nil, p)
+	case CodecZstd:
+		return zstdDecoder.DecodeAll(p, nil)
+	case CodecLZ4:
+		return io.ReadAll(lz4.NewReader(bytes.NewReader(p)))
+	default:
+		return nil, fmt.Errorf("unknown codec %s", c)
+	}
+}
@@ -0,0 +1,57 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	log_v1 "github.com/reversearrow/distributed-computing-in-go/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCodec(t *testing.T) {
+	var records []*log_v1.Record
+	for i := uint64(0); i < 10; i++ {
+		records = append(records, &log_v1.Record{
+			Value:  bytes.Repeat([]byte(fmt.Sprintf(`{"event":%d}`, i)), 20),
+			Offset: i,
+		})
+	}
+
+	for c := CodecNone; c <= CodecLZ4; c++ {
+		t.Run(c.String(), func(t *testing.T) {
+			p, err := encodeBatch(records, c, 0)
+			require.NoError(t, err)
+			require.Equal(t, byte(c), p[0])
+			if c != CodecNone {
+				plain, err := encodeBatch(records, CodecNone, 0)
+				require.NoError(t, err)
+				require.Less(t, len(p), len(plain))
+			}
+
+			got, err := unmarshalBatch(p)
+			require.NoError(t, err)
+			require.Len(t, got, len(records))
+			for i := range records {
+				require.Equal(t, records[i].Offset, got[i].Offset)
+				require.Equal(t, records[i].Value, got[i].Value)
+			}
+		})
+	}
+
+	// replicated logs write the raft index along with the records
+	p, err := encodeBatch(records, CodecSnappy, 42)
+	require.NoError(t, err)
+	index, err := batchIndex(p)
+	require.NoError(t, err)
+	require.Equal(t, uint64(42), index)
+	got, err := unmarshalBatch(p)
+	require.NoError(t, err)
+	require.Len(t, got, len(records))
+
+	_, err = encodeBatch(records, CodecLZ4+1, 0)
+	require.Error(t, err)
+
+	_, err = decodeBatch([]byte{byte(CodecLZ4 + 1), 0})
+	require.Error(t, err)
+}
@@ -0,0 +1,188 @@
+package log
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSyncInterval = 10 * time.Millisecond
+)
+
+var (
+	errCommitterClosed = errors.New("log: closed before the append was committed")
+)
+
+// committer makes appends wait until they reach the durability point
+// configured in Durability. Offsets below durable are on stable storage,
+// offsets below pending have been appended and are waited on.
+// Waiters that find no sync in progress run one on behalf of everyone
+// waiting, so concurrent appends are group committed.
+type committer struct {
+	config Durability
+	// sync commits the active segment and returns the next offset
+	// that is not guaranteed to be durable.
+	sync func() (uint64, error)
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	durable uint64
+	pending uint64
+	err     error
+	syncing bool
+	closed  bool
+
+	done chan struct{}
+	stop sync.Once
+	wg   sync.WaitGroup
+}
+
+func newCommitter(c Durability, durable uint64, fn func() (uint64, error)) *committer {
+	if c.Mode == SyncBatch && c.Interval == 0 {
+		c.Interval = defaultSyncInterval
+	}
+
+	cm := &committer{
+		config:  c,
+		sync:    fn,
+		durable: durable,
+		pending: durable,
+		done:    make(chan struct{}),
+	}
+	cm.cond = sync.NewCond(&cm.mu)
+
+	if c.Mode == SyncBatch {
+		cm.wg.Add(1)
+		go cm.run()
+	}
+	return cm
+}
+
+// wait blocks until the record at off is durable.
+func (c *committer) wait(off uint64) error {
+	if c.config.Mode == SyncOS {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if off+1 > c.pending {
+		c.pending = off + 1
+	}
+
+	for c.durable <= off {
+		if c.closed {
+			return errCommitterClosed
+		}
+
+		if !c.syncing && c.due(off) {
+			if err := c.commit(); err != nil {
+				return err
+			}
+			continue
+		}
+		c.cond.Wait()
+		if c.err != nil && c.durable <= off {
+			return c.err
+		}
+	}
+	return nil
+}
+
+// due reports whether the waiter for off should trigger a sync instead
+// of waiting for the next tick.
+func (c *committer) due(off uint64) bool {
+	if c.config.Mode == SyncAlways {
+		return true
+	}
+	return c.config.MaxRecords > 0 && off+1-c.durable >= c.config.MaxRecords
+}
+
+// commit runs a sync with c.mu released and wakes up the waiters.
+// It must be called with c.mu held and no sync in progress.
+func (c *committer) commit() error {
+	c.syncing = true
+	c.mu.Unlock()
+	next, err := c.sync()
+	c.mu.Lock()
+	c.syncing = false
+	c.err = err
+
+	if err == nil && next > c.durable {
+		c.durable = next
+	}
+	c.cond.Broadcast()
+	return err
+}
+
+// truncate forgets about the offsets from next onwards, they are about
+// to be appended again.
+func (c *committer) truncate(next uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.durable > next {
+		c.durable = next
+	}
+	if c.pending > next {
+		c.pending = next
+	}
+}
+
+// reset starts over with every offset below next durable, when the
+// log is replaced by one starting at next.
+func (c *committer) reset(next uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.durable, c.pending = next, next
+	c.cond.Broadcast()
+}
+
+// run syncs pending appends every interval.
+func (c *committer) run() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(c.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.mu.Lock()
+			if !c.syncing && c.pending > c.durable {
+				// errors are returned to the waiters when they
+				// retry the sync themselves.
+				_ = c.commit()
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+// Close stops the background sync, commits whatever is pending and
+// releases the waiters.
+func (c *committer) Close() error {
+	c.stop.Do(func() {
+		close(c.done)
+	})
+	c.wg.Wait()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.syncing {
+		c.cond.Wait()
+	}
+
+	var err error
+	if !c.closed && c.pending > c.durable {
+		err = c.commit()
+	}
+	c.closed = true
+	c.cond.Broadcast()
+	return err
+}
@@ -0,0 +1,138 @@
+package log
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSegment hands out offsets and counts the syncs the committer
+// runs against it.
+type fakeSegment struct {
+	next  uint64
+	syncs uint64
+	delay time.Duration
+	err   error
+}
+
+func (f *fakeSegment) append() uint64 {
+	return atomic.AddUint64(&f.next, 1) - 1
+}
+
+func (f *fakeSegment) sync() (uint64, error) {
+	atomic.AddUint64(&f.syncs, 1)
+	next := atomic.LoadUint64(&f.next)
+	time.Sleep(f.delay)
+	return next, f.err
+}
+
+func TestCommitter(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T){
+		"sync always group commits concurrent appends": testCommitterGroupCommit,
+		"sync batch commits every max records":         testCommitterMaxRecords,
+		"sync batch commits every interval":            testCommitterInterval,
+		"sync errors are returned to waiters":          testCommitterSyncError,
+		"close commits pending appends":                testCommitterClose,
+	} {
+		t.Run(scenario, fn)
+	}
+}
+
+func testCommitterGroupCommit(t *testing.T) {
+	f := &fakeSegment{delay: 10 * time.Millisecond}
+	c := newCommitter(Durability{Mode: SyncAlways}, 0, f.sync)
+	defer c.Close()
+
+	const appends = 50
+	var wg sync.WaitGroup
+	for i := 0; i < appends; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			off := f.append()
+			require.NoError(t, c.wait(off))
+		}()
+	}
+	wg.Wait()
+
+	require.Less(t, atomic.LoadUint64(&f.syncs), uint64(appends))
+	require.Equal(t, uint64(appends), c.durable)
+}
+
+func testCommitterMaxRecords(t *testing.T) {
+	f := &fakeSegment{}
+	c := newCommitter(Durability{
+		Mode:       SyncBatch,
+		MaxRecords: 3,
+		Interval:   time.Hour,
+	}, 0, f.sync)
+	defer c.Close()
+
+	offs := []uint64{f.append(), f.append(), f.append()}
+
+	var wg sync.WaitGroup
+	for _, off := range offs[:2] {
+		wg.Add(1)
+		go func(off uint64) {
+			defer wg.Done()
+			require.NoError(t, c.wait(off))
+		}(off)
+	}
+
+	require.Never(t, func() bool {
+		return atomic.LoadUint64(&f.syncs) > 0
+	}, 50*time.Millisecond, 5*time.Millisecond)
+
+	require.NoError(t, c.wait(offs[2]))
+	wg.Wait()
+	require.Equal(t, uint64(1), atomic.LoadUint64(&f.syncs))
+}
+
+func testCommitterInterval(t *testing.T) {
+	f := &fakeSegment{}
+	c := newCommitter(Durability{
+		Mode:       SyncBatch,
+		MaxRecords: 1000,
+		Interval:   5 * time.Millisecond,
+	}, 0, f.sync)
+	defer c.Close()
+
+	require.NoError(t, c.wait(f.append()))
+	require.Equal(t, uint64(1), atomic.LoadUint64(&f.syncs))
+}
+
+func testCommitterSyncError(t *testing.T) {
+	f := &fakeSegment{err: errors.New("disk on fire")}
+	c := newCommitter(Durability{Mode: SyncAlways}, 0, f.sync)
+
+	require.ErrorIs(t, c.wait(f.append()), f.err)
+	require.Equal(t, uint64(0), c.durable)
+}
+
+func testCommitterClose(t *testing.T) {
+	f := &fakeSegment{}
+	c := newCommitter(Durability{
+		Mode:     SyncBatch,
+		Interval: time.Hour,
+	}, 0, f.sync)
+
+	done := make(chan error)
+	go func() {
+		done <- c.wait(f.append())
+	}()
+
+	require.Eventually(t, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.pending == 1
+	}, time.Second, time.Millisecond)
+
+	require.NoError(t, c.Close())
+	require.NoError(t, <-done)
+
+	require.ErrorIs(t, c.wait(f.append()), errCommitterClosed)
+}
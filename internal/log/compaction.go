@@ -0,0 +1,253 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	log_v1 "github.com/reversearrow/distributed-computing-in-go/api/v1"
+)
+
+const (
+	defaultCompactionInterval = time.Minute
+
+	// compactionDir is where compacted segments are written before
+	// they replace the original ones.
+	compactionDir = ".compaction"
+)
+
+// batch is a frame's worth of records along with the codec it was
+// written with.
+type batch struct {
+	codec   Codec
+	records []*log_v1.Record
+}
+
+// startCompaction runs the cleaner in the background when compaction
+// is enabled.
+func startCompaction(l *Log) *job {
+	c := l.Config.Compaction
+	if !c.Enabled {
+		return startJob(0, nil)
+	}
+
+	interval := c.Interval
+	if interval == 0 {
+		interval = defaultCompactionInterval
+	}
+
+	return startJob(interval, func() {
+		compacted, err := l.Compact()
+		if c.Report != nil && (len(compacted) > 0 || err != nil) {
+			c.Report(compacted, err)
+		}
+	})
+}
+
+// Compact rewrites the closed segments keeping only the latest record
+// of every key, and drops the tombstones older than
+// Config.Compaction.TombstoneRetention. Keys are only compared across
+// closed segments, the active segment is left alone. Offsets are
+// preserved, reading a compacted away offset returns the next record.
+// It returns the rewritten segments.
+func (l *Log) Compact() ([]SegmentInfo, error) {
+	l.cleaner.Lock()
+	defer l.cleaner.Unlock()
+
+	l.mu.RLock()
+	if l.closed {
+		l.mu.RUnlock()
+		return nil, ErrClosed
+	}
+	closed := append([]*segment(nil), l.segments[:len(l.segments)-1]...)
+	l.mu.RUnlock()
+
+	if len(closed) == 0 {
+		return nil, nil
+	}
+
+	// closed segments are not written to anymore, so they are read
+	// without holding the log's lock.
+	latest := make(map[string]uint64)
+	for _, s := range closed {
+		if err := s.scan(0, s.store.size, func(_ uint64, _ Codec, records []*log_v1.Record) error {
+			for _, record := range records {
+				if len(record.Key) > 0 {
+					latest[string(record.Key)] = record.Offset
+				}
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	deadline := l.Config.now().Add(-l.Config.Compaction.TombstoneRetention)
+	keep := func(record *log_v1.Record) bool {
+		if len(record.Key) == 0 {
+			return true
+		}
+		if latest[string(record.Key)] != record.Offset {
+			return false
+		}
+		// tombstones are kept until every consumer had a chance
+		// to see them.
+		return len(record.Value) > 0 ||
+			record.AppendTime.AsTime().After(deadline)
+	}
+
+	fs := l.Config.fs()
+	dir := filepath.Join(l.Dir, compactionDir)
+	if err := fs.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := fs.Mkdir(dir, 0755); err != nil {
+		return nil, err
+	}
+	defer fs.RemoveAll(dir)
+
+	var compacted []SegmentInfo
+	for _, s := range closed {
+		info, ok, err := l.compact(s, dir, keep)
+		if err != nil {
+			return compacted, fmt.Errorf("compacting segment %d: %w", s.baseOffset, err)
+		}
+		if ok {
+			compacted = append(compacted, info)
+		}
+	}
+	return compacted, nil
+}
+
+// compact rewrites the segment with the records to keep in dir and
+// swaps it in place of the original. It reports false when there was
+// nothing to remove.
+func (l *Log) compact(s *segment, dir string, keep func(*log_v1.Record) bool) (SegmentInfo, bool, error) {
+	var (
+		batches []batch
+		dropped bool
+	)
+	if err := s.scan(0, s.store.size, func(_ uint64, c Codec, records []*log_v1.Record) error {
+		var kept []*log_v1.Record
+		for _, record := range records {
+			if keep(record) {
+				kept = append(kept, record)
+				continue
+			}
+			dropped = true
+		}
+		if len(kept) > 0 {
+			batches = append(batches, batch{codec: c, records: kept})
+		}
+		return nil
+	}); err != nil {
+		return SegmentInfo{}, false, err
+	}
+
+	if !dropped {
+		return SegmentInfo{}, false, nil
+	}
+
+	cleaned, err := newSegment(dir, s.baseOffset, l.Config)
+	if err != nil {
+		return SegmentInfo{}, false, err
+	}
+	// replicated logs are never compacted, batches carry no raft index
+	for _, b := range batches {
+		if _, err := cleaned.write(b.records, b.codec, 0); err != nil {
+			cleaned.Remove()
+			return SegmentInfo{}, false, err
+		}
+	}
+	if err := cleaned.store.Sync(); err != nil {
+		cleaned.Remove()
+		return SegmentInfo{}, false, err
+	}
+	// the files are closed before they are moved in place
+	if err := cleaned.Close(); err != nil {
+		return SegmentInfo{}, false, err
+	}
+
+	return l.swapCompacted(s, cleaned)
+}
+
+// swapCompacted replaces the files of s with the ones of cleaned and
+// reopens the segment. The indexes of s are removed before its store is
+// replaced, so a crash in between leaves a store the indexes are
+// rebuilt from. A segment left without records is removed, unless it is
+// the first one, and the previous segment takes over its offsets.
+func (l *Log) swapCompacted(s, cleaned *segment) (SegmentInfo, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	i := l.segmentIndex(s)
+	if i < 0 {
+		return SegmentInfo{}, false, cleaned.remove()
+	}
+
+	if i > 0 && cleaned.store.size == 0 {
+		info := s.Info()
+		if err := s.Remove(); err != nil {
+			return SegmentInfo{}, false, err
+		}
+		l.segments[i-1].nextOffset = s.nextOffset
+		l.segments = append(l.segments[:i], l.segments[i+1:]...)
+
+		info.Size = 0
+		return info, true, cleaned.remove()
+	}
+
+	if err := s.Close(); err != nil {
+		return SegmentInfo{}, false, err
+	}
+
+	err := replaceFiles(l.Config.fs(), [][2]string{
+		{"", s.index.Name()},
+		{"", s.timeIndex.Name()},
+		{cleaned.store.Name(), s.store.Name()},
+		{cleaned.index.Name(), s.index.Name()},
+		{cleaned.timeIndex.Name(), s.timeIndex.Name()},
+	})
+
+	// whatever made it to disk is reopened, so the log stays usable
+	reopened, openErr := newSegment(l.Dir, s.baseOffset, l.Config)
+	if openErr != nil {
+		return SegmentInfo{}, false, openErr
+	}
+	reopened.nextOffset = s.nextOffset
+	l.segments[i] = reopened
+
+	if err != nil {
+		return SegmentInfo{}, false, err
+	}
+	return reopened.Info(), true, nil
+}
+
+// replaceFiles renames every pair's source over its destination, and
+// removes the destination when there is no source.
+func replaceFiles(fs FS, pairs [][2]string) error {
+	for _, pair := range pairs {
+		if pair[0] == "" {
+			if err := fs.Remove(pair[1]); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		if err := fs.Rename(pair[0], pair[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// segmentIndex returns the position of s in the log's segments, -1 when
+// it has been removed. It must be called with l.mu held.
+func (l *Log) segmentIndex(s *segment) int {
+	for i, segment := range l.segments {
+		if segment == s {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,188 @@
+package log
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	log_v1 "github.com/reversearrow/distributed-computing-in-go/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompaction(t *testing.T) {
+	dir, err := os.MkdirTemp("", "compaction-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	clock := &testClock{now: time.Date(2023, 9, 1, 2, 0, 0, 0, time.UTC)}
+	c := Config{Now: clock.Now}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	c.Compaction.TombstoneRetention = time.Hour
+
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	for _, kv := range [][2]string{
+		{"a", "1"}, {"b", "1"}, {"a", "2"},
+		{"c", "1"}, {"b", "2"}, {"a", ""},
+		{"c", "2"}, {"", "keyless"}, {"b", "3"},
+		{"d", "1"},
+	} {
+		record := &log_v1.Record{Value: []byte(kv[1])}
+		if kv[0] != "" {
+			record.Key = []byte(kv[0])
+		}
+		_, err := log.Append(record)
+		require.NoError(t, err)
+	}
+	require.Len(t, log.segments, 4)
+
+	// reads keep working while segments are swapped
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				_, err := log.Read(6)
+				require.NoError(t, err)
+			}
+		}
+	}()
+
+	compacted, err := log.Compact()
+	close(done)
+	wg.Wait()
+	require.NoError(t, err)
+	require.Len(t, compacted, 2)
+	// the first segment is kept without records to hold its offsets
+	require.Equal(t, uint64(0), compacted[0].Size)
+	require.Len(t, log.segments, 4)
+
+	for _, tt := range []struct {
+		off, want uint64
+		key       string
+	}{
+		{off: 0, want: 5, key: "a"},
+		{off: 3, want: 5, key: "a"},
+		{off: 5, want: 5, key: "a"},
+		{off: 6, want: 6, key: "c"},
+		{off: 7, want: 7},
+		{off: 8, want: 8, key: "b"},
+		{off: 9, want: 9, key: "d"},
+	} {
+		read, err := log.Read(tt.off)
+		require.NoError(t, err)
+		require.Equal(t, tt.want, read.Offset)
+		require.Equal(t, tt.key, string(read.Key))
+	}
+
+	// the tombstone outlived its retention
+	clock.Add(2 * time.Hour)
+	compacted, err = log.Compact()
+	require.NoError(t, err)
+	require.Len(t, compacted, 1)
+	require.Equal(t, uint64(3), compacted[0].BaseOffset)
+	require.Len(t, log.segments, 3)
+
+	read, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), read.Offset)
+
+	compacted, err = log.Compact()
+	require.NoError(t, err)
+	require.Empty(t, compacted)
+
+	// compacted segments survive reopening the log
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+
+	read, err = log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), read.Offset)
+	read, err = log.Read(8)
+	require.NoError(t, err)
+	require.Equal(t, []byte("3"), read.Value)
+
+	off, err := log.Append(&log_v1.Record{Value: []byte("after compaction")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), off)
+	require.NoError(t, log.Close())
+}
+
+func TestCompactionRunsInBackground(t *testing.T) {
+	dir, err := os.MkdirTemp("", "compaction-background-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	reports := make(chan []SegmentInfo, 1)
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth
+	c.Compaction.Enabled = true
+	c.Compaction.Interval = time.Millisecond
+	c.Compaction.Report = func(compacted []SegmentInfo, err error) {
+		if err != nil {
+			t.Errorf("compaction failed: %v", err)
+		}
+		select {
+		case reports <- compacted:
+		default:
+		}
+	}
+
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&log_v1.Record{
+			Key:   []byte("key"),
+			Value: []byte("hello world"),
+		})
+		require.NoError(t, err)
+	}
+
+	select {
+	case compacted := <-reports:
+		require.NotEmpty(t, compacted)
+	case <-time.After(5 * time.Second):
+		t.Fatal("compaction did not run")
+	}
+
+	require.NoError(t, log.Close())
+}
+
+func TestCompactionHoldsOffTruncation(t *testing.T) {
+	dir, err := os.MkdirTemp("", "compaction-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&log_v1.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	// the segments a running compaction scans are not removed under it
+	log.cleaner.Lock()
+	done := make(chan error, 2)
+	go func() { done <- log.Truncate(0) }()
+	go func() { done <- log.truncateFrom(2) }()
+	select {
+	case <-done:
+		t.Fatal("truncated while the cleaner was running")
+	case <-time.After(50 * time.Millisecond):
+	}
+	log.cleaner.Unlock()
+	require.NoError(t, <-done)
+	require.NoError(t, <-done)
+}
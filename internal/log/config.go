@@ -1,8 +1,52 @@
 package log
 
+import (
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
 // Config to centralize configuration for the log package
 type Config struct {
-	Segment Segment
+	Segment    Segment
+	Durability Durability
+	Retention  Retention
+	Compaction Compaction
+	Raft       Raft
+	// Codec compresses the batches of records appended without an
+	// explicit codec.
+	Codec Codec
+	// Now returns the time appended records are stamped with,
+	// time.Now when nil.
+	Now func() time.Time
+	// FS holds the files of the log, the operating system's when
+	// nil. A DistributedLog keeps raft's stable store and snapshots
+	// on the operating system's file system whatever FS is.
+	FS FS
+}
+
+func (c Config) fs() FS {
+	if c.FS == nil {
+		return OSFS{}
+	}
+	return c.FS
+}
+
+func (c Config) now() time.Time {
+	if c.Now == nil {
+		return time.Now()
+	}
+	return c.Now()
+}
+
+func (c *Config) setDefaults() {
+	if c.Segment.MaxStoreBytes == 0 {
+		c.Segment.MaxStoreBytes = defaultMaxSegmentBytes
+	}
+
+	if c.Segment.MaxIndexBytes == 0 {
+		c.Segment.MaxIndexBytes = defaultMaxIndexBytes
+	}
 }
 
 // Segment stores configuration for the segment.
@@ -10,4 +54,74 @@ type Segment struct {
 	MaxStoreBytes uint64
 	MaxIndexBytes uint64
 	InitialOffset uint64
+	// Report is called for every segment whose index or store was
+	// repaired when it was opened.
+	Report func(Repair)
+}
+
+// SyncMode defines when appended records are committed to stable
+// storage.
+type SyncMode int
+
+const (
+	// SyncOS hands every append to the operating system and leaves
+	// it to decide when to write it to disk.
+	SyncOS SyncMode = iota
+	// SyncAlways fsyncs the store before an append returns.
+	SyncAlways
+	// SyncBatch fsyncs the store once MaxRecords appends are pending
+	// or every Interval, whichever comes first.
+	SyncBatch
+)
+
+// Durability stores configuration for when an append is acknowledged.
+// Concurrent appends waiting on the same durability point share a
+// single fsync.
+type Durability struct {
+	Mode       SyncMode
+	MaxRecords uint64
+	Interval   time.Duration
+}
+
+// Retention stores configuration for removing old segments. Only whole
+// closed segments are removed, oldest first, the active segment is
+// always kept.
+type Retention struct {
+	// MaxAge removes segments whose last record was appended
+	// longer ago.
+	MaxAge time.Duration
+	// MaxBytes removes segments while the log's stores hold more
+	// bytes.
+	MaxBytes uint64
+	// Interval between two checks, a minute when zero.
+	Interval time.Duration
+	// Report is called after every check that removed segments
+	// or failed.
+	Report func(removed []SegmentInfo, err error)
+}
+
+// Compaction stores configuration for the cleaner that rewrites closed
+// segments keeping only the latest record of every key. Records without
+// a key are never removed.
+type Compaction struct {
+	Enabled bool
+	// TombstoneRetention is how long a record with a key and no
+	// value is kept after it is appended, so consumers get to see
+	// the deletion.
+	TombstoneRetention time.Duration
+	// Interval between two passes, a minute when zero.
+	Interval time.Duration
+	// Report is called after every pass that rewrote segments or
+	// failed.
+	Report func(compacted []SegmentInfo, err error)
+}
+
+// Raft stores configuration for the replication of a DistributedLog.
+type Raft struct {
+	raft.Config
+	// StreamLayer carries the traffic between the servers.
+	StreamLayer *StreamLayer
+	// Bootstrap starts a new cluster with this server as its only
+	// voter.
+	Bootstrap bool
 }
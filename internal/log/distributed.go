@@ -0,0 +1,704 @@
+package log
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	log_v1 "github.com/reversearrow/distributed-computing-in-go/api/v1"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// RaftRPC is the first byte of every connection of the raft
+	// stream layer, it tells them apart from the other connections
+	// sharing the port.
+	RaftRPC = 1
+
+	applyTimeout     = 10 * time.Second
+	transportTimeout = 10 * time.Second
+	transportMaxPool = 5
+	snapshotsRetain  = 1
+
+	// the log store keeps the term and type of a raft entry in front
+	// of its data.
+	termWidth        = 8
+	typeWidth        = 1
+	entryHeaderWidth = termWidth + typeWidth
+)
+
+var errNotRaftRPC = errors.New("log: not a raft connection")
+
+// RequestType identifies the command carried by a raft log entry.
+type RequestType uint8
+
+const (
+	AppendRequestType RequestType = 0
+)
+
+// ErrNotLeader is returned when a write reaches a server that is not
+// the leader. Leader is the address of the leader, empty when there is
+// none at the moment.
+type ErrNotLeader struct {
+	Leader string
+}
+
+func (e ErrNotLeader) Error() string {
+	if e.Leader == "" {
+		return "log: not the leader, no leader elected"
+	}
+	return fmt.Sprintf("log: not the leader, the leader is %s", e.Leader)
+}
+
+func (e ErrNotLeader) Unwrap() error {
+	return raft.ErrNotLeader
+}
+
+// DistributedLog is a Log replicated across servers with raft. Appends
+// go through the leader, reads are served by every server from its own
+// copy of the log. Offsets of the replicated log must not move, so it
+// is never compacted.
+type DistributedLog struct {
+	config Config
+	log    *Log
+
+	raft        *raft.Raft
+	raftLog     *logStore
+	stableStore *raftboltdb.BoltStore
+}
+
+// NewDistributedLog opens the replicated log stored in dataDir and
+// starts its raft server.
+func NewDistributedLog(dataDir string, config Config) (*DistributedLog, error) {
+	config.Compaction = Compaction{}
+	l := &DistributedLog{
+		config: config,
+	}
+
+	if err := l.setupLog(dataDir); err != nil {
+		return nil, err
+	}
+	if err := l.setupRaft(dataDir); err != nil {
+		l.close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *DistributedLog) setupLog(dataDir string) error {
+	logDir := filepath.Join(dataDir, "log")
+	if err := l.config.fs().MkdirAll(logDir, 0755); err != nil {
+		return err
+	}
+
+	var err error
+	l.log, err = NewLog(logDir, l.config)
+	return err
+}
+
+func (l *DistributedLog) setupRaft(dataDir string) error {
+	logDir := filepath.Join(dataDir, "raft", "log")
+	if err := l.config.fs().MkdirAll(logDir, 0755); err != nil {
+		return err
+	}
+
+	// raft indexes start at 1 and raft removes the entries it no
+	// longer needs itself.
+	logConfig := l.config
+	logConfig.Segment.InitialOffset = 1
+	logConfig.Retention = Retention{}
+
+	fsm, err := newFSM(l.log)
+	if err != nil {
+		return err
+	}
+
+	l.raftLog, err = newLogStore(logDir, logConfig)
+	if err != nil {
+		return err
+	}
+
+	// raft's stable store and snapshots are files of their own that
+	// do not go through Config.FS, they are always kept on the
+	// operating system's file system.
+	if err := os.MkdirAll(filepath.Join(dataDir, "raft"), 0755); err != nil {
+		return err
+	}
+	l.stableStore, err = raftboltdb.NewBoltStore(
+		filepath.Join(dataDir, "raft", "stable"),
+	)
+	if err != nil {
+		return err
+	}
+
+	snapshotStore, err := raft.NewFileSnapshotStore(
+		filepath.Join(dataDir, "raft"),
+		snapshotsRetain,
+		os.Stderr,
+	)
+	if err != nil {
+		return err
+	}
+
+	transport := raft.NewNetworkTransport(
+		l.config.Raft.StreamLayer,
+		transportMaxPool,
+		transportTimeout,
+		os.Stderr,
+	)
+
+	config := raft.DefaultConfig()
+	config.LocalID = l.config.Raft.LocalID
+	if l.config.Raft.HeartbeatTimeout != 0 {
+		config.HeartbeatTimeout = l.config.Raft.HeartbeatTimeout
+	}
+	if l.config.Raft.ElectionTimeout != 0 {
+		config.ElectionTimeout = l.config.Raft.ElectionTimeout
+	}
+	if l.config.Raft.LeaderLeaseTimeout != 0 {
+		config.LeaderLeaseTimeout = l.config.Raft.LeaderLeaseTimeout
+	}
+	if l.config.Raft.CommitTimeout != 0 {
+		config.CommitTimeout = l.config.Raft.CommitTimeout
+	}
+	if l.config.Raft.SnapshotThreshold != 0 {
+		config.SnapshotThreshold = l.config.Raft.SnapshotThreshold
+	}
+
+	l.raft, err = raft.NewRaft(
+		config,
+		fsm,
+		l.raftLog,
+		l.stableStore,
+		snapshotStore,
+		transport,
+	)
+	if err != nil {
+		return err
+	}
+
+	hasState, err := raft.HasExistingState(l.raftLog, l.stableStore, snapshotStore)
+	if err != nil {
+		return err
+	}
+	if l.config.Raft.Bootstrap && !hasState {
+		err = l.raft.BootstrapCluster(raft.Configuration{
+			Servers: []raft.Server{{
+				ID:      config.LocalID,
+				Address: transport.LocalAddr(),
+			}},
+		}).Error()
+	}
+	return err
+}
+
+// Append replicates the record and returns its offset once a majority
+// of the servers stored it.
+func (l *DistributedLog) Append(record *log_v1.Record) (uint64, error) {
+	first, _, err := l.AppendBatchWithCodec(
+		[]*log_v1.Record{record},
+		l.config.Codec,
+	)
+	return first, err
+}
+
+// AppendBatch replicates the records as a contiguous range of offsets.
+func (l *DistributedLog) AppendBatch(records []*log_v1.Record) (first, last uint64, err error) {
+	return l.AppendBatchWithCodec(records, l.config.Codec)
+}
+
+// AppendBatchWithCodec is AppendBatch with the batch compressed on disk
+// with the given codec. It fails with ErrNotLeader unless this server
+// is the leader.
+func (l *DistributedLog) AppendBatchWithCodec(records []*log_v1.Record, c Codec) (first, last uint64, err error) {
+	if len(records) == 0 {
+		return 0, 0, ErrEmptyBatch
+	}
+
+	// records are stamped once by the leader, so every server keeps
+	// the same append times.
+	now := l.config.now()
+	for _, record := range records {
+		record.AppendTime = timestamppb.New(now)
+	}
+
+	res, err := l.apply(AppendRequestType, c, &log_v1.ProduceBatchRequest{
+		Records: records,
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// the FSM responds with nil to entries it already applied
+	batch, ok := res.(*log_v1.ProduceBatchResponse)
+	if !ok {
+		return 0, 0, fmt.Errorf("log: unexpected response %T to an append", res)
+	}
+	return batch.FirstOffset, batch.LastOffset, nil
+}
+
+// apply replicates the request through raft and returns the response of
+// the FSM. Entries are laid out as the request type and codec bytes
+// followed by the marshalled request.
+func (l *DistributedLog) apply(reqType RequestType, c Codec, req proto.Message) (interface{}, error) {
+	b, err := proto.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	future := l.raft.Apply(append([]byte{byte(reqType), byte(c)}, b...), applyTimeout)
+	if err := future.Error(); err != nil {
+		if errors.Is(err, raft.ErrNotLeader) {
+			return nil, ErrNotLeader{Leader: string(l.raft.Leader())}
+		}
+		return nil, err
+	}
+
+	res := future.Response()
+	if err, ok := res.(error); ok {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Read returns the record at off from this server's copy of the log.
+// Followers may lag behind the leader.
+func (l *DistributedLog) Read(off uint64) (*log_v1.Record, error) {
+	return l.log.Read(off)
+}
+
+// Info describes this server's copy of the log.
+func (l *DistributedLog) Info() (Info, error) {
+	return l.log.Info()
+}
+
+// Appended returns a channel closed once records are applied to this
+// server's copy of the log after the call.
+func (l *DistributedLog) Appended() <-chan struct{} {
+	return l.log.Appended()
+}
+
+// OffsetForTime returns the offset of the first record appended at or
+// after t in this server's copy of the log.
+func (l *DistributedLog) OffsetForTime(t time.Time) (uint64, error) {
+	return l.log.OffsetForTime(t)
+}
+
+// Join adds the server as a voter of the cluster. A server already
+// known under the same ID or address is replaced.
+func (l *DistributedLog) Join(id, addr string) error {
+	configFuture := l.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return err
+	}
+
+	serverID := raft.ServerID(id)
+	serverAddr := raft.ServerAddress(addr)
+	for _, srv := range configFuture.Configuration().Servers {
+		if srv.ID != serverID && srv.Address != serverAddr {
+			continue
+		}
+		if srv.ID == serverID && srv.Address == serverAddr {
+			// already joined
+			return nil
+		}
+		if err := l.raft.RemoveServer(srv.ID, 0, 0).Error(); err != nil {
+			return err
+		}
+	}
+
+	return l.raft.AddVoter(serverID, serverAddr, 0, 0).Error()
+}
+
+// Leave removes the server from the cluster.
+func (l *DistributedLog) Leave(id string) error {
+	return l.raft.RemoveServer(raft.ServerID(id), 0, 0).Error()
+}
+
+// GetServers returns the servers of the cluster, their addresses being
+// the ones raft and gRPC are served on.
+func (l *DistributedLog) GetServers() ([]*log_v1.Server, error) {
+	future := l.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+
+	leader := l.raft.Leader()
+	var servers []*log_v1.Server
+	for _, server := range future.Configuration().Servers {
+		servers = append(servers, &log_v1.Server{
+			Id:       string(server.ID),
+			RpcAddr:  string(server.Address),
+			IsLeader: leader == server.Address,
+		})
+	}
+	return servers, nil
+}
+
+// WaitForLeader blocks until the cluster elected a leader or the
+// timeout expires.
+func (l *DistributedLog) WaitForLeader(timeout time.Duration) error {
+	timeoutc := time.After(timeout)
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-timeoutc:
+			return fmt.Errorf("log: no leader elected after %s", timeout)
+		case <-ticker.C:
+			if l.raft.Leader() != "" {
+				return nil
+			}
+		}
+	}
+}
+
+// Close shuts the raft server down and closes the logs.
+func (l *DistributedLog) Close() error {
+	if err := l.raft.Shutdown().Error(); err != nil {
+		return err
+	}
+	return l.close()
+}
+
+func (l *DistributedLog) close() error {
+	var errs []error
+	if l.stableStore != nil {
+		errs = append(errs, l.stableStore.Close())
+	}
+	if l.raftLog != nil {
+		errs = append(errs, l.raftLog.Close())
+	}
+	if l.log != nil {
+		errs = append(errs, l.log.Close())
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var _ raft.FSM = (*fsm)(nil)
+
+// fsm applies the replicated commands to the log. Raft replays the
+// entries following its last snapshot on start, so the batches carry
+// the index of the entry that appended them and the entries the log
+// already holds are skipped.
+type fsm struct {
+	log *Log
+	// lastApplied is the index of the last entry applied to the log.
+	lastApplied uint64
+}
+
+func newFSM(log *Log) (*fsm, error) {
+	f := &fsm{log: log}
+	return f, f.loadLastApplied()
+}
+
+// loadLastApplied reads the index of the last entry applied from the
+// last batch of the log, 0 when it holds none.
+func (f *fsm) loadLastApplied() (err error) {
+	f.lastApplied, err = f.log.lastIndex()
+	return err
+}
+
+func (f *fsm) Apply(record *raft.Log) interface{} {
+	if len(record.Data) < 2 {
+		return fmt.Errorf("log: raft entry %d too short", record.Index)
+	}
+	if record.Index <= f.lastApplied {
+		return nil
+	}
+
+	switch RequestType(record.Data[0]) {
+	case AppendRequestType:
+		return f.applyAppend(record.Index, Codec(record.Data[1]), record.Data[2:])
+	}
+	return fmt.Errorf("log: unknown request type %d", record.Data[0])
+}
+
+func (f *fsm) applyAppend(index uint64, c Codec, b []byte) interface{} {
+	var req log_v1.ProduceBatchRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return err
+	}
+
+	next, err := f.log.nextOffset()
+	if err != nil {
+		return err
+	}
+	for i, record := range req.Records {
+		record.Offset = next + uint64(i)
+	}
+	first, last, err := f.log.writeBatch(req.Records, c, index)
+	if err != nil {
+		return err
+	}
+	f.lastApplied = index
+	return &log_v1.ProduceBatchResponse{
+		FirstOffset: first,
+		LastOffset:  last,
+	}
+}
+
+// Snapshot captures the stores of the log as they are now, the frames
+// are copied out later by Persist.
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	return &snapshot{reader: f.log.Reader()}, nil
+}
+
+// Restore replaces the log with the frames of a snapshot, keeping the
+// offsets and append times of their records.
+func (f *fsm) Restore(r io.ReadCloser) error {
+	defer r.Close()
+
+	header := make([]byte, frameHeaderWidth)
+	var reset bool
+	for {
+		_, err := io.ReadFull(r, header)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		p := make([]byte, enc.Uint64(header[:binaryLengthWidth]))
+		if _, err := io.ReadFull(r, p); err != nil {
+			return err
+		}
+		if crc32.Checksum(p, crcTable) != enc.Uint32(header[binaryLengthWidth:]) {
+			return errors.New("log: corrupt snapshot frame")
+		}
+
+		records, err := unmarshalBatch(p)
+		if err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			continue
+		}
+		index, err := batchIndex(p)
+		if err != nil {
+			return err
+		}
+
+		// the log starts over at the snapshot's first offset
+		if !reset {
+			if err := f.log.Reset(records[0].Offset); err != nil {
+				return err
+			}
+			reset = true
+		}
+		if _, _, err := f.log.writeBatch(records, frameCodec(p), index); err != nil {
+			return err
+		}
+	}
+
+	if !reset {
+		if err := f.log.Reset(f.log.Config.Segment.InitialOffset); err != nil {
+			return err
+		}
+	}
+	return f.loadLastApplied()
+}
+
+var _ raft.FSMSnapshot = (*snapshot)(nil)
+
+type snapshot struct {
+	reader io.Reader
+}
+
+func (s *snapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := io.Copy(sink, s.reader); err != nil {
+		_ = sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *snapshot) Release() {}
+
+var _ raft.LogStore = (*logStore)(nil)
+
+// logStore keeps the raft log in a Log, raft indexes being the offsets
+// of the records and their values the entries laid out by encodeEntry.
+type logStore struct {
+	*Log
+}
+
+func newLogStore(dir string, c Config) (*logStore, error) {
+	log, err := NewLog(dir, c)
+	if err != nil {
+		return nil, err
+	}
+	return &logStore{log}, nil
+}
+
+func (l *logStore) FirstIndex() (uint64, error) {
+	return l.LowestOffset()
+}
+
+func (l *logStore) LastIndex() (uint64, error) {
+	return l.HighestOffset()
+}
+
+func (l *logStore) GetLog(index uint64, out *raft.Log) error {
+	in, err := l.Read(index)
+	if errors.As(err, &ErrOffSetOutOfRange{}) {
+		return raft.ErrLogNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if in.Offset != index {
+		return raft.ErrLogNotFound
+	}
+
+	out.Index = in.Offset
+	return decodeEntry(in.Value, out)
+}
+
+func (l *logStore) StoreLog(record *raft.Log) error {
+	return l.StoreLogs([]*raft.Log{record})
+}
+
+// StoreLogs appends the entries, which must follow the last one stored.
+func (l *logStore) StoreLogs(records []*raft.Log) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	last, err := l.HighestOffset()
+	if err != nil {
+		return err
+	}
+	if records[0].Index != last+1 {
+		return fmt.Errorf("log: raft entry %d does not follow entry %d", records[0].Index, last)
+	}
+
+	batch := make([]*log_v1.Record, len(records))
+	for i, record := range records {
+		batch[i] = &log_v1.Record{Value: encodeEntry(record)}
+	}
+	_, _, err = l.AppendBatch(batch)
+	return err
+}
+
+// encodeEntry lays out the term, type and data of a raft entry as the
+// value of a record.
+func encodeEntry(record *raft.Log) []byte {
+	p := make([]byte, entryHeaderWidth+len(record.Data))
+	enc.PutUint64(p, record.Term)
+	p[termWidth] = byte(record.Type)
+	copy(p[entryHeaderWidth:], record.Data)
+	return p
+}
+
+// decodeEntry reads the term, type and data of a raft entry from the
+// value of a record written by encodeEntry.
+func decodeEntry(p []byte, out *raft.Log) error {
+	if len(p) < entryHeaderWidth {
+		return fmt.Errorf("log: raft entry %d too short", out.Index)
+	}
+	out.Term = enc.Uint64(p[:termWidth])
+	out.Type = raft.LogType(p[termWidth])
+	out.Data = p[entryHeaderWidth:]
+	return nil
+}
+
+// DeleteRange removes the entries from min to max. Raft either removes
+// a prefix of the log once it is covered by a snapshot, or the suffix
+// that conflicts with the leader's log.
+func (l *logStore) DeleteRange(min, max uint64) error {
+	first, err := l.LowestOffset()
+	if err != nil {
+		return err
+	}
+	if min <= first {
+		return l.Truncate(max)
+	}
+	return l.truncateFrom(min)
+}
+
+var _ raft.StreamLayer = (*StreamLayer)(nil)
+
+// StreamLayer is the raft transport's connection layer. It shares its
+// listener with other protocols: outgoing connections start with the
+// RaftRPC byte, which incoming ones are expected to start with.
+type StreamLayer struct {
+	ln              net.Listener
+	serverTLSConfig *tls.Config
+	peerTLSConfig   *tls.Config
+}
+
+// NewStreamLayer returns a stream layer accepting connections from ln.
+// Connections are encrypted when the TLS configurations are set.
+func NewStreamLayer(ln net.Listener, serverTLSConfig, peerTLSConfig *tls.Config) *StreamLayer {
+	return &StreamLayer{
+		ln:              ln,
+		serverTLSConfig: serverTLSConfig,
+		peerTLSConfig:   peerTLSConfig,
+	}
+}
+
+func (s *StreamLayer) Dial(addr raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := dialer.Dial("tcp", string(addr))
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write([]byte{byte(RaftRPC)}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if s.peerTLSConfig != nil {
+		conn = tls.Client(conn, s.peerTLSConfig)
+	}
+	return conn, nil
+}
+
+func (s *StreamLayer) Accept() (net.Conn, error) {
+	conn, err := s.ln.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if b[0] != byte(RaftRPC) {
+		conn.Close()
+		return nil, errNotRaftRPC
+	}
+
+	if s.serverTLSConfig != nil {
+		return tls.Server(conn, s.serverTLSConfig), nil
+	}
+	return conn, nil
+}
+
+func (s *StreamLayer) Close() error {
+	return s.ln.Close()
+}
+
+func (s *StreamLayer) Addr() net.Addr {
+	return s.ln.Addr()
+}
@@ -0,0 +1,283 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	log_v1 "github.com/reversearrow/distributed-computing-in-go/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDistributedLog(t *testing.T) {
+	var logs []*DistributedLog
+	nodeCount := 3
+
+	for i := 0; i < nodeCount; i++ {
+		dataDir, err := os.MkdirTemp("", "distributed-log-test")
+		require.NoError(t, err)
+		defer os.RemoveAll(dataDir)
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		config := Config{}
+		config.Raft.StreamLayer = NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", i))
+		config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Raft.Bootstrap = i == 0
+
+		l, err := NewDistributedLog(dataDir, config)
+		require.NoError(t, err)
+		defer l.Close()
+
+		if i == 0 {
+			require.NoError(t, l.WaitForLeader(3*time.Second))
+		} else {
+			require.NoError(t, logs[0].Join(fmt.Sprintf("%d", i), ln.Addr().String()))
+		}
+		logs = append(logs, l)
+	}
+
+	records := []*log_v1.Record{
+		{Value: []byte("first")},
+		{Value: []byte("second")},
+	}
+	for _, record := range records {
+		off, err := logs[0].Append(record)
+		require.NoError(t, err)
+
+		// committed records can be read from every server, with the
+		// append time the leader gave them
+		require.Eventually(t, func() bool {
+			for _, l := range logs {
+				got, err := l.Read(off)
+				if err != nil || !bytes.Equal(got.Value, record.Value) {
+					return false
+				}
+				if !got.AppendTime.AsTime().Equal(record.AppendTime.AsTime()) {
+					return false
+				}
+			}
+			return true
+		}, 500*time.Millisecond, 10*time.Millisecond)
+	}
+
+	// followers reject writes and point at the leader
+	_, err := logs[1].Append(&log_v1.Record{Value: []byte("rejected")})
+	var notLeader ErrNotLeader
+	require.ErrorAs(t, err, &notLeader)
+	require.ErrorIs(t, err, raft.ErrNotLeader)
+	require.Equal(t, logs[0].config.Raft.StreamLayer.Addr().String(), notLeader.Leader)
+
+	require.NoError(t, logs[0].Leave("1"))
+
+	first, last, err := logs[0].AppendBatch([]*log_v1.Record{
+		{Value: []byte("third")},
+		{Value: []byte("fourth")},
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), first)
+	require.Equal(t, uint64(3), last)
+
+	require.Eventually(t, func() bool {
+		record, err := logs[2].Read(last)
+		return err == nil && bytes.Equal(record.Value, []byte("fourth"))
+	}, 500*time.Millisecond, 10*time.Millisecond)
+
+	// the server that left is no longer replicated to
+	time.Sleep(50 * time.Millisecond)
+	_, err = logs[1].Read(first)
+	require.Error(t, err)
+}
+
+func TestLogStore(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-store-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.InitialOffset = 1
+	c.Segment.MaxIndexBytes = entWidth * 4
+	s, err := newLogStore(dir, c)
+	require.NoError(t, err)
+	defer s.Close()
+
+	entries := func(from, to, term uint64) []*raft.Log {
+		var logs []*raft.Log
+		for i := from; i <= to; i++ {
+			logs = append(logs, &raft.Log{
+				Index: i,
+				Term:  term,
+				Type:  raft.LogCommand,
+				Data:  []byte(fmt.Sprintf("%d-%d", term, i)),
+			})
+		}
+		return logs
+	}
+	requireEntries := func(from, to, term uint64) {
+		t.Helper()
+		for i := from; i <= to; i++ {
+			var out raft.Log
+			require.NoError(t, s.GetLog(i, &out))
+			require.Equal(t, i, out.Index)
+			require.Equal(t, term, out.Term)
+			require.Equal(t, raft.LogCommand, out.Type)
+			require.Equal(t, []byte(fmt.Sprintf("%d-%d", term, i)), out.Data)
+		}
+	}
+
+	require.NoError(t, s.StoreLogs(entries(1, 10, 1)))
+	require.Error(t, s.StoreLogs(entries(12, 12, 1)))
+	requireEntries(1, 10, 1)
+
+	var out raft.Log
+	require.ErrorIs(t, s.GetLog(11, &out), raft.ErrLogNotFound)
+
+	// a conflicting suffix is removed in the middle of a segment and
+	// of a batch, and replaced by the leader's entries
+	require.NoError(t, s.DeleteRange(7, 10))
+	last, err := s.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), last)
+	require.ErrorIs(t, s.GetLog(7, &out), raft.ErrLogNotFound)
+
+	require.NoError(t, s.StoreLogs(entries(7, 9, 2)))
+	requireEntries(1, 6, 1)
+	requireEntries(7, 9, 2)
+
+	// the prefix covered by a snapshot is removed segment by segment
+	require.NoError(t, s.DeleteRange(1, 4))
+	first, err := s.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), first)
+	requireEntries(5, 6, 1)
+
+	require.NoError(t, s.DeleteRange(first, 9))
+	require.NoError(t, s.StoreLog(entries(10, 10, 2)[0]))
+	requireEntries(10, 10, 2)
+
+	// the store is found as it was left after a restart
+	require.NoError(t, s.Close())
+	s, err = newLogStore(dir, c)
+	require.NoError(t, err)
+	first, err = s.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), first)
+	requireEntries(10, 10, 2)
+}
+
+func TestFSMSnapshot(t *testing.T) {
+	dir, err := os.MkdirTemp("", "fsm-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	require.NoError(t, os.Mkdir(dir+"/source", 0755))
+	source, err := NewLog(dir+"/source", c)
+	require.NoError(t, err)
+	defer source.Close()
+
+	appended := []*log_v1.Record{
+		{Value: []byte("first")},
+		{Value: []byte("second")},
+		{Value: []byte("third")},
+	}
+	_, _, err = source.AppendBatch(appended)
+	require.NoError(t, err)
+	// retention removed the first segment
+	require.NoError(t, source.Truncate(1))
+
+	snap, err := (&fsm{log: source}).Snapshot()
+	require.NoError(t, err)
+	// appends made after the snapshot are not part of it
+	_, err = source.Append(&log_v1.Record{Value: []byte("fourth")})
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	_, err = io.Copy(&buf, snap.(*snapshot).reader)
+	require.NoError(t, err)
+
+	// the restored records keep the append times they were given
+	c.Now = func() time.Time { return time.Now().Add(time.Hour) }
+	require.NoError(t, os.Mkdir(dir+"/target", 0755))
+	target, err := NewLog(dir+"/target", c)
+	require.NoError(t, err)
+	defer target.Close()
+	_, err = target.Append(&log_v1.Record{Value: []byte("stale")})
+	require.NoError(t, err)
+
+	f := &fsm{log: target}
+	require.NoError(t, f.Restore(io.NopCloser(&buf)))
+
+	lowest, err := target.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), lowest)
+	highest, err := target.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), highest)
+
+	record, err := target.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, []byte("third"), record.Value)
+	require.True(t, appended[2].AppendTime.AsTime().Equal(record.AppendTime.AsTime()))
+}
+
+func TestDistributedLogRestart(t *testing.T) {
+	dataDir, err := os.MkdirTemp("", "distributed-log-restart-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+
+	// the logs are kept in memory, raft's own files on disk
+	fs := NewMemFS()
+	open := func(ln net.Listener) *DistributedLog {
+		config := Config{FS: fs}
+		config.Raft.StreamLayer = NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = "0"
+		config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Raft.Bootstrap = true
+
+		l, err := NewDistributedLog(dataDir, config)
+		require.NoError(t, err)
+		require.NoError(t, l.WaitForLeader(3*time.Second))
+		return l
+	}
+
+	l := open(ln)
+	for i := 0; i < 3; i++ {
+		off, err := l.Append(&log_v1.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+	}
+	require.NoError(t, l.Close())
+
+	// raft replays its log on start, the entries already applied are
+	// not appended again.
+	ln, err = net.Listen("tcp", addr)
+	require.NoError(t, err)
+	l = open(ln)
+	defer l.Close()
+
+	off, err := l.Append(&log_v1.Record{Value: []byte("after the restart")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	info, err := l.Info()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), info.NextOffset)
+}
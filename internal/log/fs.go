@@ -0,0 +1,96 @@
+package log
+
+import (
+	"io"
+	"os"
+
+	"github.com/tysonmote/gommap"
+)
+
+// FS is the file system the log keeps its segments in.
+type FS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	ReadDir(name string) ([]os.DirEntry, error)
+	Mkdir(name string, perm os.FileMode) error
+	MkdirAll(name string, perm os.FileMode) error
+	Remove(name string) error
+	RemoveAll(name string) error
+	Rename(oldName, newName string) error
+}
+
+// File is a file opened in an FS.
+type File interface {
+	io.Writer
+	io.ReaderAt
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+	// Map maps the file in memory, writes to the returned bytes are
+	// written to the file. The mapping covers the size of the file
+	// at the time Map is called.
+	Map() ([]byte, error)
+	// SyncMap commits the writes to the mapping to stable storage.
+	SyncMap() error
+	// Unmap releases the mapping, the bytes Map returned must not be
+	// used afterwards.
+	Unmap() error
+}
+
+// OSFS is the FS of the operating system, files are mapped in memory
+// with mmap.
+type OSFS struct{}
+
+func (OSFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &osFile{File: f}, nil
+}
+
+func (OSFS) Stat(name string) (os.FileInfo, error)        { return os.Stat(name) }
+func (OSFS) ReadDir(name string) ([]os.DirEntry, error)   { return os.ReadDir(name) }
+func (OSFS) Mkdir(name string, perm os.FileMode) error    { return os.Mkdir(name, perm) }
+func (OSFS) MkdirAll(name string, perm os.FileMode) error { return os.MkdirAll(name, perm) }
+func (OSFS) Remove(name string) error                     { return os.Remove(name) }
+func (OSFS) RemoveAll(name string) error                  { return os.RemoveAll(name) }
+func (OSFS) Rename(oldName, newName string) error         { return os.Rename(oldName, newName) }
+
+type osFile struct {
+	*os.File
+	mmap gommap.MMap
+}
+
+func (f *osFile) Map() ([]byte, error) {
+	mmap, err := gommap.Map(
+		f.Fd(),
+		gommap.PROT_READ|gommap.PROT_WRITE,
+		gommap.MAP_SHARED,
+	)
+	if err != nil {
+		return nil, err
+	}
+	f.mmap = mmap
+	return mmap, nil
+}
+
+func (f *osFile) SyncMap() error {
+	if f.mmap == nil {
+		return nil
+	}
+	return f.mmap.Sync(gommap.MS_SYNC)
+}
+
+func (f *osFile) Unmap() error {
+	if f.mmap == nil {
+		return nil
+	}
+	if err := f.mmap.UnsafeUnmap(); err != nil {
+		return err
+	}
+	f.mmap = nil
+	return nil
+}
@@ -2,9 +2,7 @@ package log
 
 import (
 	"io"
-	"os"
-
-	"github.com/tysonmote/gommap"
+	"sort"
 )
 
 var (
@@ -15,32 +13,28 @@ var (
 
 // index defines persisted and memory-mapped file
 type index struct {
-	file *os.File
-	mmap gommap.MMap
+	file File
+	mmap []byte
 	size uint64
 }
 
 // newIndex creates a new index file, persistent file based on
 // the configuration.
-func newIndex(f *os.File, c Config) (*index, error) {
+func newIndex(f File, c Config) (*index, error) {
 	idx := &index{
 		file: f,
 	}
-	fi, err := os.Stat(f.Name())
+	fi, err := f.Stat()
 	if err != nil {
 		return nil, err
 	}
 	idx.size = uint64(fi.Size())
 
 	// pre-emptively grows the file to max index bytes
-	if err := os.Truncate(f.Name(), int64(c.Segment.MaxIndexBytes)); err != nil {
+	if err := f.Truncate(int64(c.Segment.MaxIndexBytes)); err != nil {
 		return nil, err
 	}
-	if idx.mmap, err = gommap.Map(
-		idx.file.Fd(),
-		gommap.PROT_READ|gommap.PROT_WRITE,
-		gommap.MAP_SHARED,
-	); err != nil {
+	if idx.mmap, err = f.Map(); err != nil {
 		return nil, err
 	}
 	return idx, nil
@@ -50,7 +44,7 @@ func newIndex(f *os.File, c Config) (*index, error) {
 // to the persisted file and that the persisted file has
 // flushed its contents to the stable storage.
 func (i *index) Close() error {
-	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
+	if err := i.file.SyncMap(); err != nil {
 		return err
 	}
 
@@ -58,6 +52,13 @@ func (i *index) Close() error {
 		return err
 	}
 
+	// the file is unmapped before it shrinks, a mapping past the end
+	// of a file faults when it is touched.
+	if err := i.file.Unmap(); err != nil {
+		return err
+	}
+	i.mmap = nil
+
 	// re-sizes the file to the actual file size
 	if err := i.file.Truncate(int64(i.size)); err != nil {
 		return err
@@ -94,6 +95,25 @@ func (i *index) Read(offset int64) (out uint32, pos uint64, err error) {
 	return out, pos, nil
 }
 
+// Search returns the first entry whose offset is at or after the given
+// offset. Entries are found right away unless the segment has been
+// compacted, in which case they are binary searched.
+func (i *index) Search(offset uint32) (out uint32, pos uint64, err error) {
+	if out, pos, err = i.Read(int64(offset)); err == nil && out == offset {
+		return out, pos, nil
+	}
+
+	n := int(i.size / entWidth)
+	k := sort.Search(n, func(k int) bool {
+		out, _, _ := i.Read(int64(k))
+		return out >= offset
+	})
+	if k == n {
+		return 0, 0, io.EOF
+	}
+	return i.Read(int64(k))
+}
+
 // Write appends the given offset and position to the index.
 func (i *index) Write(offset uint32, pos uint64) error {
 	if uint64(len(i.mmap)) < i.size+entWidth {
@@ -21,7 +21,8 @@ func TestIndex(t *testing.T) {
 	c := Config{}
 	c.Segment.MaxIndexBytes = 1024
 
-	idx, err := newIndex(f, c)
+	file := &osFile{File: f}
+	idx, err := newIndex(file, c)
 	require.NoError(t, err)
 	require.Equal(t, f.Name(), idx.Name())
 
@@ -50,9 +51,11 @@ func TestIndex(t *testing.T) {
 
 	err = idx.Close()
 	require.NoError(t, err)
+	// the mapping is released with the file
+	require.Nil(t, file.mmap)
 
 	f, _ = os.OpenFile(f.Name(), os.O_RDWR, 0600)
-	idx, err = newIndex(f, c)
+	idx, err = newIndex(&osFile{File: f}, c)
 	require.NoError(t, err)
 
 	off, pos, err := idx.Read(-1)
@@ -0,0 +1,322 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	log_v1 "github.com/reversearrow/distributed-computing-in-go/api/v1"
+)
+
+// The functions of this file inspect the files of a log that is not
+// open, without modifying them, unlike NewLog which repairs segments.
+
+// SegmentFiles lists the files of a segment, a path is empty when the
+// file is missing.
+type SegmentFiles struct {
+	BaseOffset uint64
+	Store      string
+	Index      string
+	TimeIndex  string
+}
+
+// ListSegments returns the segments of the log stored in dir, sorted by
+// base offset, and the files of dir that belong to no segment.
+func ListSegments(dir string) (segments []SegmentFiles, orphans []string, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	byBase := make(map[uint64]*SegmentFiles)
+	for _, entry := range entries {
+		name := filepath.Join(dir, entry.Name())
+		ext := filepath.Ext(entry.Name())
+		base, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), ext), 10, 64)
+		if entry.IsDir() || err != nil {
+			orphans = append(orphans, name)
+			continue
+		}
+
+		s, ok := byBase[base]
+		if !ok {
+			s = &SegmentFiles{BaseOffset: base}
+		}
+		switch ext {
+		case ".store":
+			s.Store = name
+		case ".index":
+			s.Index = name
+		case ".timeindex":
+			s.TimeIndex = name
+		default:
+			orphans = append(orphans, name)
+			continue
+		}
+		byBase[base] = s
+	}
+
+	for _, s := range byBase {
+		segments = append(segments, *s)
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].BaseOffset < segments[j].BaseOffset
+	})
+	return segments, orphans, nil
+}
+
+// IndexEntry is an entry of a segment's index: the absolute offset of a
+// record and the position of its batch's frame in the store.
+type IndexEntry struct {
+	Offset   uint64
+	Position uint64
+}
+
+// ReadIndex returns the entries of the index file of the segment based
+// at baseOffset. The zeroed entries an index is pre-grown with, which
+// it keeps when it is not closed properly, are left out.
+func ReadIndex(file string, baseOffset uint64) ([]IndexEntry, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []IndexEntry
+	for i := uint64(0); (i+1)*entWidth <= uint64(len(b)); i++ {
+		p := b[i*entWidth : (i+1)*entWidth]
+		off := enc.Uint32(p[:offsetWidth])
+		pos := enc.Uint64(p[offsetWidth:])
+		// offsets ascend, so only the first entry may be zero
+		if i > 0 && off == 0 {
+			break
+		}
+		entries = append(entries, IndexEntry{
+			Offset:   baseOffset + uint64(off),
+			Position: pos,
+		})
+	}
+	return entries, nil
+}
+
+// Frame is a frame of a segment's store holding a batch of records.
+type Frame struct {
+	Position uint64
+	// Size is the number of bytes of the frame, header included.
+	Size    uint64
+	Codec   Codec
+	Records []*log_v1.Record
+}
+
+// ScanStore calls fn with every frame of the store file in order. It
+// stops at the first frame that cannot be read, returning an
+// ErrCorruptRecord for torn or corrupt frames.
+func ScanStore(file string, fn func(Frame) error) error {
+	f, err := OSFS{}.OpenFile(file, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	s, err := newStore(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	defer s.File.Close()
+
+	for pos := uint64(0); pos < s.size; {
+		p, err := s.Read(pos)
+		if err != nil {
+			return err
+		}
+
+		records, err := unmarshalBatch(p)
+		if err != nil {
+			return fmt.Errorf("decoding batch at pos %d in %s: %w", pos, file, err)
+		}
+
+		frame := Frame{
+			Position: pos,
+			Size:     uint64(len(p)) + frameHeaderWidth,
+			Codec:    frameCodec(p),
+			Records:  records,
+		}
+		if err := fn(frame); err != nil {
+			return err
+		}
+		pos += frame.Size
+	}
+	return nil
+}
+
+// Problem is an inconsistency found in the files of a log.
+type Problem struct {
+	File    string
+	Message string
+	// Warning is set for inconsistencies the log may legitimately
+	// have, or repairs when it is opened.
+	Warning bool
+}
+
+func (p Problem) String() string {
+	level := "error"
+	if p.Warning {
+		level = "warning"
+	}
+	return fmt.Sprintf("%s: %s: %s", level, p.File, p.Message)
+}
+
+// Verify checks the files of the log stored in dir: that every index
+// entry points to a valid frame holding its record, that every record
+// of the store is indexed, that no file is orphaned and that segments
+// follow each other without gaps or overlaps.
+func Verify(dir string) ([]Problem, error) {
+	segments, orphans, err := ListSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []Problem
+	for _, orphan := range orphans {
+		problems = append(problems, Problem{
+			File:    orphan,
+			Message: "file belongs to no segment",
+			Warning: true,
+		})
+	}
+
+	var prev *SegmentFiles
+	var prevNext uint64
+	for i := range segments {
+		s := &segments[i]
+		next, segmentProblems, err := verifySegment(s)
+		if err != nil {
+			return nil, err
+		}
+		problems = append(problems, segmentProblems...)
+		if s.Store == "" {
+			continue
+		}
+
+		if prev != nil {
+			switch {
+			case prevNext > s.BaseOffset:
+				problems = append(problems, Problem{
+					File: s.Store,
+					Message: fmt.Sprintf(
+						"overlaps the previous segment, which holds offsets up to %d",
+						prevNext-1,
+					),
+				})
+			case prevNext < s.BaseOffset:
+				problems = append(problems, Problem{
+					File: s.Store,
+					Message: fmt.Sprintf(
+						"offsets %d to %d are missing before the segment, as expected when compacted away",
+						prevNext, s.BaseOffset-1,
+					),
+					Warning: true,
+				})
+			}
+		}
+		prev, prevNext = s, next
+	}
+	return problems, nil
+}
+
+// verifySegment checks the files of a segment and returns the offset
+// following its last record.
+func verifySegment(s *SegmentFiles) (next uint64, problems []Problem, err error) {
+	next = s.BaseOffset
+	if s.Store == "" {
+		for _, file := range []string{s.Index, s.TimeIndex} {
+			if file != "" {
+				problems = append(problems, Problem{
+					File:    file,
+					Message: "the segment's store is missing",
+				})
+			}
+		}
+		return next, problems, nil
+	}
+
+	// the offsets held by the frame at every position
+	frames := make(map[uint64]map[uint64]bool)
+	err = ScanStore(s.Store, func(f Frame) error {
+		offsets := make(map[uint64]bool, len(f.Records))
+		for _, r := range f.Records {
+			if r.Offset < next {
+				problems = append(problems, Problem{
+					File: s.Store,
+					Message: fmt.Sprintf(
+						"record at offset %d in frame at pos %d is out of order, expected offset %d or above",
+						r.Offset, f.Position, next,
+					),
+				})
+			}
+			offsets[r.Offset] = true
+			next = r.Offset + 1
+		}
+		frames[f.Position] = offsets
+		return nil
+	})
+	if err != nil {
+		problems = append(problems, Problem{
+			File:    s.Store,
+			Message: fmt.Sprintf("%v, the frames from there on are unreadable", err),
+		})
+	}
+
+	if s.Index == "" {
+		problems = append(problems, Problem{
+			File:    s.Store,
+			Message: "the segment's index is missing, it is rebuilt when the log is opened",
+			Warning: true,
+		})
+		return next, problems, nil
+	}
+
+	entries, err := ReadIndex(s.Index, s.BaseOffset)
+	if err != nil {
+		return 0, nil, err
+	}
+	indexed := make(map[uint64]bool, len(entries))
+	for _, e := range entries {
+		offsets, ok := frames[e.Position]
+		switch {
+		case !ok:
+			problems = append(problems, Problem{
+				File:    s.Index,
+				Message: fmt.Sprintf("offset %d points to pos %d, where no valid frame starts", e.Offset, e.Position),
+			})
+		case !offsets[e.Offset]:
+			problems = append(problems, Problem{
+				File:    s.Index,
+				Message: fmt.Sprintf("offset %d points to the frame at pos %d, which does not hold it", e.Offset, e.Position),
+			})
+		}
+		indexed[e.Offset] = true
+	}
+
+	var unindexed []uint64
+	for _, offsets := range frames {
+		for off := range offsets {
+			if !indexed[off] {
+				unindexed = append(unindexed, off)
+			}
+		}
+	}
+	if len(unindexed) > 0 {
+		sort.Slice(unindexed, func(i, j int) bool { return unindexed[i] < unindexed[j] })
+		problems = append(problems, Problem{
+			File: s.Index,
+			Message: fmt.Sprintf(
+				"%d records from offset %d are not indexed, they are indexed when the log is opened",
+				len(unindexed), unindexed[0],
+			),
+			Warning: true,
+		})
+	}
+	return next, problems, nil
+}
@@ -0,0 +1,100 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	log_v1 "github.com/reversearrow/distributed-computing-in-go/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspect(t *testing.T) {
+	dir, err := os.MkdirTemp("", "inspect-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 7; i++ {
+		_, err := log.Append(&log_v1.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	segments, orphans, err := ListSegments(dir)
+	require.NoError(t, err)
+	require.Empty(t, orphans)
+	require.Len(t, segments, 3)
+	for i, s := range segments {
+		require.Equal(t, uint64(i*3), s.BaseOffset)
+		require.NotEmpty(t, s.Store)
+		require.NotEmpty(t, s.Index)
+		require.NotEmpty(t, s.TimeIndex)
+	}
+
+	entries, err := ReadIndex(segments[1].Index, segments[1].BaseOffset)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	var frames []Frame
+	require.NoError(t, ScanStore(segments[1].Store, func(f Frame) error {
+		frames = append(frames, f)
+		return nil
+	}))
+	require.Len(t, frames, 3)
+	for i, e := range entries {
+		require.Equal(t, uint64(3+i), e.Offset)
+		require.Equal(t, frames[i].Position, e.Position)
+		require.Equal(t, "record "+fmt.Sprint(3+i), string(frames[i].Records[0].Value))
+	}
+
+	problems, err := Verify(dir)
+	require.NoError(t, err)
+	require.Empty(t, problems)
+
+	// an orphan file and a lost index are warned about
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0600))
+	require.NoError(t, os.Remove(segments[2].Index))
+	problems, err = Verify(dir)
+	require.NoError(t, err)
+	require.Len(t, problems, 2)
+	for _, p := range problems {
+		require.True(t, p.Warning, p)
+	}
+
+	// a missing segment leaves a gap
+	require.NoError(t, os.Remove(segments[1].Store))
+	problems, err = Verify(dir)
+	require.NoError(t, err)
+	require.Contains(t, messages(problems), "offsets 3 to 5 are missing before the segment, as expected when compacted away")
+	require.Contains(t, messages(problems), "the segment's store is missing")
+
+	// corrupt frames are reported along with the index entries
+	// pointing to them
+	b, err := os.ReadFile(segments[0].Store)
+	require.NoError(t, err)
+	b[frames[1].Position+frameHeaderWidth]++
+	require.NoError(t, os.WriteFile(segments[0].Store, b, 0644))
+	problems, err = Verify(dir)
+	require.NoError(t, err)
+	var errs int
+	for _, p := range problems {
+		if !p.Warning {
+			errs++
+		}
+	}
+	// the corrupt frame, the two entries pointing past it and the
+	// index and time index of the missing store
+	require.Equal(t, 5, errs, problems)
+}
+
+func messages(problems []Problem) []string {
+	var msgs []string
+	for _, p := range problems {
+		msgs = append(msgs, p.Message)
+	}
+	return msgs
+}
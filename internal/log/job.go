@@ -0,0 +1,51 @@
+package log
+
+import (
+	"sync"
+	"time"
+)
+
+// job runs a maintenance task of the log in the background until it is
+// closed.
+type job struct {
+	done chan struct{}
+	stop sync.Once
+	wg   sync.WaitGroup
+}
+
+// startJob calls fn every interval. A nil fn starts nothing, so that
+// the returned job can always be closed.
+func startJob(interval time.Duration, fn func()) *job {
+	j := &job{
+		done: make(chan struct{}),
+	}
+	if fn == nil {
+		return j
+	}
+
+	j.wg.Add(1)
+	go func() {
+		defer j.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-j.done:
+				return
+			case <-ticker.C:
+				fn()
+			}
+		}
+	}()
+	return j
+}
+
+// Close stops the job and waits for a running call to return.
+func (j *job) Close() {
+	j.stop.Do(func() {
+		close(j.done)
+	})
+	j.wg.Wait()
+}
@@ -1,14 +1,16 @@
 package log
 
 import (
+	"errors"
+	"fmt"
 	log_v1 "github.com/reversearrow/distributed-computing-in-go/api/v1"
 	"io"
-	"os"
 	"path"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 const (
@@ -16,54 +18,102 @@ const (
 	defaultMaxIndexBytes   = 1024
 )
 
+// ErrEmptyBatch is returned when AppendBatch is called without records.
+var (
+	ErrEmptyBatch = errors.New("log: empty batch")
+	// ErrClosed is returned by the methods of a closed log.
+	ErrClosed = errors.New("log: closed")
+	// ErrFull is returned when a segment's index has no room left for
+	// the records appended.
+	ErrFull = errors.New("log: segment full")
+)
+
+// ErrOffSetOutOfRange is returned when reading an offset the log does
+// not hold. Low is the lowest offset held and High the offset the next
+// record appended gets, so an Offset below Low was removed by retention
+// and one at or above High is yet to be appended.
 type ErrOffSetOutOfRange struct {
+	Offset uint64
+	Low    uint64
+	High   uint64
 }
 
 func (e ErrOffSetOutOfRange) Error() string {
-	return ""
+	return fmt.Sprintf("log: offset %d out of range [%d, %d)", e.Offset, e.Low, e.High)
+}
+
+// Behind reports whether the offset was removed from the log, rather
+// than not appended yet.
+func (e ErrOffSetOutOfRange) Behind() bool {
+	return e.Offset < e.Low
 }
 
 type Log struct {
 	mu sync.RWMutex
+	// cleaner serializes the removal and rewriting of closed
+	// segments by retention and compaction.
+	cleaner sync.Mutex
 
 	Dir    string
 	Config Config
 
 	activeSegment *segment
 	segments      []*segment
+	committer     *committer
+	retention     *job
+	compaction    *job
+	// appended is closed and replaced when records are appended.
+	appended chan struct{}
+	closed   bool
 }
 
 func NewLog(dir string, c Config) (*Log, error) {
-	if c.Segment.MaxIndexBytes == 0 {
-		c.Segment.MaxStoreBytes = defaultMaxSegmentBytes
-	}
-
-	if c.Segment.MaxIndexBytes == 0 {
-		c.Segment.MaxIndexBytes = defaultMaxIndexBytes
+	c.setDefaults()
+	l := &Log{
+		Dir:      dir,
+		Config:   c,
+		appended: make(chan struct{}),
 	}
 
-	l := &Log{
-		Dir:    dir,
-		Config: c,
+	if err := l.loadSegments(); err != nil {
+		return nil, err
 	}
 
-	return l, l.setup()
+	l.committer = newCommitter(
+		l.Config.Durability,
+		l.activeSegment.nextOffset,
+		l.syncActive,
+	)
+	l.retention = startRetention(l)
+	l.compaction = startCompaction(l)
+	return l, nil
 }
 
-func (l *Log) setup() error {
-	files, err := os.ReadDir(l.Dir)
+// loadSegments opens the segments stored in the log's directory, or
+// creates the first one when there is none. It must be called with
+// l.mu held once the log is shared.
+func (l *Log) loadSegments() error {
+	files, err := l.Config.fs().ReadDir(l.Dir)
 	if err != nil {
 		return err
 	}
 
+	// a segment is recovered from either of its files, a missing
+	// index is rebuilt from the store.
 	var baseOffSets []uint64
+	seen := make(map[uint64]bool)
 	for _, file := range files {
-		offStr := strings.TrimSuffix(
-			file.Name(),
-			path.Ext(file.Name()),
-		)
+		ext := path.Ext(file.Name())
+		if ext != ".store" && ext != ".index" {
+			continue
+		}
 
-		off, _ := strconv.ParseUint(offStr, 10, 0)
+		offStr := strings.TrimSuffix(file.Name(), ext)
+		off, err := strconv.ParseUint(offStr, 10, 0)
+		if err != nil || seen[off] {
+			continue
+		}
+		seen[off] = true
 		baseOffSets = append(baseOffSets, off)
 	}
 
@@ -75,58 +125,267 @@ func (l *Log) setup() error {
 		if err := l.newSegment(baseOffSets[i]); err != nil {
 			return err
 		}
-		i++
 	}
 
-	if l.segments == nil {
-		if err = l.newSegment(
-			l.Config.Segment.InitialOffset,
-		); err != nil {
-			return err
-		}
+	// a compacted segment may have lost its last records, it still
+	// covers the offsets up to the next segment.
+	for i := 1; i < len(l.segments); i++ {
+		l.segments[i-1].nextOffset = l.segments[i].baseOffset
 	}
 
+	if l.segments == nil {
+		return l.newSegment(l.Config.Segment.InitialOffset)
+	}
 	return nil
 }
 
+// Append writes the record to the active segment and returns once it
+// has reached the durability point set in Config.Durability.
 func (l *Log) Append(record *log_v1.Record) (uint64, error) {
+	off, _, err := l.AppendBatchWithCodec(
+		[]*log_v1.Record{record},
+		l.Config.Codec,
+	)
+	return off, err
+}
+
+// AppendBatch writes the records to the log as a contiguous range of
+// offsets, rolling segments in the middle of the batch when needed, and
+// returns the first and last offsets once the batch is durable.
+func (l *Log) AppendBatch(records []*log_v1.Record) (first, last uint64, err error) {
+	return l.AppendBatchWithCodec(records, l.Config.Codec)
+}
+
+// AppendBatchWithCodec is AppendBatch with the batch compressed on disk
+// with the given codec instead of Config.Codec.
+func (l *Log) AppendBatchWithCodec(records []*log_v1.Record, c Codec) (first, last uint64, err error) {
+	return l.appendBatch(records, func(s *segment, records []*log_v1.Record) (uint64, error) {
+		return s.AppendBatch(records, c)
+	})
+}
+
+// writeBatch appends records that already carry their offsets and
+// append times and keeps both, as replicated logs do with the records
+// stamped by the leader. The first record must get the log's next
+// offset. The raft index of the entry appending the records is written
+// along with them, see lastIndex.
+func (l *Log) writeBatch(records []*log_v1.Record, c Codec, index uint64) (first, last uint64, err error) {
+	return l.appendBatch(records, func(s *segment, records []*log_v1.Record) (uint64, error) {
+		if records[0].Offset != s.nextOffset {
+			return 0, fmt.Errorf("log: record %d does not follow offset %d", records[0].Offset, s.nextOffset)
+		}
+		return s.write(records, c, index)
+	})
+}
+
+// appendBatch appends the records with write, part by part when they
+// span segments, and waits for them to be durable.
+func (l *Log) appendBatch(records []*log_v1.Record, write func(*segment, []*log_v1.Record) (uint64, error)) (first, last uint64, err error) {
+	if len(records) == 0 {
+		return 0, 0, ErrEmptyBatch
+	}
+
+	first, last, err = l.writeParts(records, write)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if err := l.committer.wait(last); err != nil {
+		return 0, 0, err
+	}
+	return first, last, nil
+}
+
+// writeParts writes the records to the active segment, rolling it
+// whenever it is full.
+func (l *Log) writeParts(records []*log_v1.Record, write func(*segment, []*log_v1.Record) (uint64, error)) (first, last uint64, err error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if l.closed {
+		return 0, 0, ErrClosed
+	}
+	defer l.notifyLocked()
+
+	next := l.activeSegment.nextOffset
+	defer func() {
+		// the part of a failed batch written so far is removed, so a
+		// failed append leaves no records behind.
+		if err == nil {
+			return
+		}
+		if terr := l.truncateLocked(next); terr != nil {
+			err = fmt.Errorf("%w (removing the partly appended batch: %v)", err, terr)
+		}
+	}()
+
+	first = next
+	for len(records) > 0 {
+		// the batch is split on segment boundaries, every part is
+		// written as a single frame.
+		n := l.activeSegment.fit(records)
+		if n > 0 {
+			last, err = write(l.activeSegment, records[:n])
+			if errors.Is(err, io.EOF) {
+				err = fmt.Errorf("%w: %d", ErrFull, l.activeSegment.baseOffset)
+			}
+			if err != nil {
+				return 0, 0, err
+			}
+			records = records[n:]
+		}
 
-	off, err := l.activeSegment.Append(record)
-	if err != nil {
-		return 0, err
+		if n == 0 || l.activeSegment.IsMaxed() {
+			// the committer only syncs the active segment, so the
+			// segment is brought to the durability point before
+			// it is rolled.
+			if err := l.persist(l.activeSegment); err != nil {
+				return 0, 0, err
+			}
+			if err := l.newSegment(l.activeSegment.nextOffset); err != nil {
+				return 0, 0, err
+			}
+		}
 	}
 
-	if l.activeSegment.IsMaxed() {
-		err = l.newSegment(off + 1)
+	return first, last, l.flushLocked()
+}
+
+// Appended returns a channel closed once records are appended to the
+// log after the call, or the log is closed. Readers that reached the
+// end of the log wait on it for more records.
+func (l *Log) Appended() <-chan struct{} {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.appended
+}
+
+// notifyLocked wakes the readers waiting for records. It must be called
+// with l.mu held.
+func (l *Log) notifyLocked() {
+	if l.closed {
+		return
 	}
+	close(l.appended)
+	l.appended = make(chan struct{})
+}
 
-	return off, err
+// flushLocked hands the active segment's buffered records to the OS
+// when durability is left to it. It must be called with l.mu held.
+func (l *Log) flushLocked() error {
+	if l.Config.Durability.Mode == SyncOS {
+		return l.activeSegment.store.Flush()
+	}
+	return nil
+}
+
+// persist writes the segment's buffered records to the file and, unless
+// durability is left to the OS, commits them to stable storage.
+func (l *Log) persist(s *segment) error {
+	if l.Config.Durability.Mode == SyncOS {
+		return s.store.Flush()
+	}
+	return s.store.Sync()
+}
+
+// syncActive commits the active segment to stable storage and returns
+// the first offset the commit may not cover.
+func (l *Log) syncActive() (uint64, error) {
+	// the lock is held through the sync, so the segment cannot be
+	// closed by a truncation or reset and the offsets it covers cannot
+	// be taken over by another segment in the meantime.
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return 0, ErrClosed
+	}
+
+	s := l.activeSegment
+	return s.nextOffset, s.store.Sync()
 }
 
 func (l *Log) Read(off uint64) (*log_v1.Record, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
+	if l.closed {
+		return nil, ErrClosed
+	}
 
-	var s *segment
+	if len(l.segments) == 0 || off < l.segments[0].baseOffset {
+		return nil, l.outOfRangeLocked(off)
+	}
+
+	// compacted away offsets resolve to the next record, which may
+	// live in a later segment.
 	for _, segment := range l.segments {
-		if segment.baseOffset <= off && off < segment.nextOffset {
-			s = segment
-			break
+		if off >= segment.nextOffset {
+			continue
+		}
+		if off < segment.baseOffset {
+			off = segment.baseOffset
+		}
+
+		record, err := segment.Read(off)
+		if errors.Is(err, io.EOF) {
+			continue
 		}
+		return record, err
+	}
+
+	return nil, l.outOfRangeLocked(off)
+}
+
+// outOfRangeLocked returns the error for reading off. It must be called
+// with l.mu held.
+func (l *Log) outOfRangeLocked(off uint64) ErrOffSetOutOfRange {
+	err := ErrOffSetOutOfRange{Offset: off}
+	if len(l.segments) > 0 {
+		err.Low = l.segments[0].baseOffset
+		err.High = l.segments[len(l.segments)-1].nextOffset
+	}
+	return err
+}
+
+// OffsetForTime returns the offset of the first record appended at or
+// after t, with millisecond precision. It returns ErrOffSetOutOfRange
+// for the offset of the next record when every record in the log is
+// older.
+func (l *Log) OffsetForTime(t time.Time) (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return 0, ErrClosed
 	}
 
-	if s == nil || s.nextOffset <= off {
-		return nil, ErrOffSetOutOfRange{}
+	for _, s := range l.segments {
+		if off, ok := s.OffsetForTime(t); ok {
+			return off, nil
+		}
 	}
-	return s.Read(off)
+	return 0, l.outOfRangeLocked(l.activeSegment.nextOffset)
 }
 
+// Close closes the segments of the log, its methods return ErrClosed
+// from then on. Closing a closed log does nothing.
 func (l *Log) Close() error {
+	l.retention.Close()
+	l.compaction.Close()
+
+	if err := l.committer.Close(); err != nil {
+		return err
+	}
+
+	l.cleaner.Lock()
+	defer l.cleaner.Unlock()
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
 
+	// readers waiting for records find out the log is closed, the
+	// channel Appended returns stays closed from then on.
+	close(l.appended)
+	l.closed = true
 	for _, segment := range l.segments {
 		if err := segment.Close(); err != nil {
 			return err
@@ -141,25 +400,89 @@ func (l *Log) Remove() error {
 		return err
 	}
 
-	return os.RemoveAll(l.Dir)
+	return l.Config.fs().RemoveAll(l.Dir)
 }
 
-func (l *Log) Reset() error {
-	if err := l.Remove(); err != nil {
+// Reset removes the log's data and starts over with an empty log whose
+// first record gets initialOffset. Concurrent reads and appends see
+// either the old or the new log.
+func (l *Log) Reset(initialOffset uint64) error {
+	l.cleaner.Lock()
+	defer l.cleaner.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	// readers waiting for records of the old log read the new one
+	defer l.notifyLocked()
+
+	for _, segment := range l.segments {
+		if err := segment.Close(); err != nil {
+			return err
+		}
+	}
+
+	fs := l.Config.fs()
+	if err := fs.RemoveAll(l.Dir); err != nil {
 		return err
 	}
-	return l.setup()
+	if err := fs.MkdirAll(l.Dir, 0755); err != nil {
+		return err
+	}
+
+	l.Config.Segment.InitialOffset = initialOffset
+	l.segments = nil
+	if err := l.loadSegments(); err != nil {
+		return err
+	}
+	l.committer.reset(l.activeSegment.nextOffset)
+	return nil
 }
 
 func (l *Log) LowestOffset() (uint64, error) {
-	l.mu.RUnlock()
+	l.mu.RLock()
 	defer l.mu.RUnlock()
+	if l.closed {
+		return 0, ErrClosed
+	}
 	return l.segments[0].baseOffset, nil
 }
 
+// nextOffset returns the offset the next record appended gets.
+func (l *Log) nextOffset() (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return 0, ErrClosed
+	}
+	return l.activeSegment.nextOffset, nil
+}
+
+// lastIndex returns the raft index written with the log's last batch,
+// 0 when the log holds none.
+func (l *Log) lastIndex() (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return 0, ErrClosed
+	}
+
+	// segments that were just rolled to hold no batch
+	for i := len(l.segments) - 1; i >= 0; i-- {
+		if l.segments[i].index.size > 0 {
+			return l.segments[i].lastIndex()
+		}
+	}
+	return 0, nil
+}
+
 func (l *Log) HighestOffset() (uint64, error) {
-	l.mu.Lock()
-	defer l.mu.Unlock()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return 0, ErrClosed
+	}
 
 	off := l.segments[len(l.segments)-1].nextOffset
 	if off == 0 {
@@ -169,9 +492,54 @@ func (l *Log) HighestOffset() (uint64, error) {
 	return off - 1, nil
 }
 
+// Info describes the log.
+type Info struct {
+	// LowestOffset is the lowest offset held by the log.
+	LowestOffset uint64
+	// NextOffset is the offset the next record appended gets.
+	NextOffset uint64
+	// Size is the number of bytes held by the segments' stores.
+	Size     uint64
+	Segments []SegmentInfo
+	// LastAppend is when the last record was appended, zero when the
+	// log holds no records.
+	LastAppend time.Time
+}
+
+// Info returns the description of the log and its segments.
+func (l *Log) Info() (Info, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return Info{}, ErrClosed
+	}
+
+	info := Info{
+		LowestOffset: l.segments[0].baseOffset,
+		NextOffset:   l.activeSegment.nextOffset,
+	}
+	for _, s := range l.segments {
+		segment := s.Info()
+		info.Size += segment.Size
+		// a segment that was just rolled to holds no records
+		if segment.NextOffset > segment.BaseOffset {
+			info.LastAppend = segment.LastAppend
+		}
+		info.Segments = append(info.Segments, segment)
+	}
+	return info, nil
+}
+
+// Truncate removes the segments whose records are all at or below
+// lowest. When none is left, the log starts over at lowest+1.
 func (l *Log) Truncate(lowest uint64) error {
+	l.cleaner.Lock()
+	defer l.cleaner.Unlock()
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
 
 	var segments []*segment
 
@@ -186,30 +554,64 @@ func (l *Log) Truncate(lowest uint64) error {
 	}
 
 	l.segments = segments
+	if len(segments) == 0 {
+		return l.newSegment(lowest + 1)
+	}
 	return nil
 }
 
+// truncateFrom removes the records from off onwards, the next record
+// appended gets off.
+func (l *Log) truncateFrom(off uint64) error {
+	l.cleaner.Lock()
+	defer l.cleaner.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	return l.truncateLocked(off)
+}
+
+// truncateLocked is truncateFrom with l.mu held. Closed segments are
+// only removed with l.cleaner held as well, unless they were rolled
+// under the same hold of l.mu and the cleaner never saw them.
+func (l *Log) truncateLocked(off uint64) error {
+	for len(l.segments) > 1 && l.segments[len(l.segments)-1].baseOffset >= off {
+		if err := l.segments[len(l.segments)-1].Remove(); err != nil {
+			return err
+		}
+		l.segments = l.segments[:len(l.segments)-1]
+	}
+
+	s := l.segments[len(l.segments)-1]
+	if err := s.truncate(off); err != nil {
+		return err
+	}
+	l.activeSegment = s
+	l.committer.truncate(s.nextOffset)
+	// readers waiting for off may now get the records replacing the
+	// removed ones.
+	l.notifyLocked()
+
+	return l.persist(s)
+}
+
+// Reader returns a reader over the frames of every segment's store, as
+// they are when Reader is called.
 func (l *Log) Reader() io.Reader {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
+	if l.closed {
+		return errReader{ErrClosed}
+	}
 	readers := make([]io.Reader, len(l.segments))
 	for i, segment := range l.segments {
-		readers[i] = &originReader{segment.store, 0}
+		readers[i] = io.NewSectionReader(segment.store, 0, int64(segment.store.size))
 	}
 	return io.MultiReader(readers...)
 }
 
-type originReader struct {
-	*store
-	off int64
-}
-
-func (o *originReader) Read(p []byte) (int, error) {
-	n, err := o.ReadAt(p, o.off)
-	o.off += int64(n)
-	return n, err
-}
-
 func (l *Log) newSegment(off uint64) error {
 	s, err := newSegment(l.Dir, off, l.Config)
 	if err != nil {
@@ -219,3 +621,12 @@ func (l *Log) newSegment(off uint64) error {
 	l.activeSegment = s
 	return nil
 }
+
+// errReader is a reader failing with err.
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
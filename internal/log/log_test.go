@@ -1,12 +1,17 @@
 package log
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	log_v1 "github.com/reversearrow/distributed-computing-in-go/api/v1"
 	"github.com/stretchr/testify/require"
-	"google.golang.org/protobuf/proto"
 	"io"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestLog(t *testing.T) {
@@ -16,6 +21,11 @@ func TestLog(t *testing.T) {
 		"append and read a record succeeds": testAppendRead,
 		"offset out of range error":         testOutOfRangeErr,
 		"reader":                            testReader,
+		"append batch":                      testAppendBatch,
+		"recover missing index":             testRecoverMissingIndex,
+		"appended notifies readers":         testAppended,
+		"info":                              testInfo,
+		"closed":                            testClosed,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			dir, err := os.MkdirTemp("", "store-test")
@@ -51,10 +61,111 @@ func testAppendRead(t *testing.T, log *Log) {
 	require.Equal(t, record.Value, read.Value)
 }
 
+func testAppendBatch(t *testing.T, log *Log) {
+	_, _, err := log.AppendBatch(nil)
+	require.ErrorIs(t, err, ErrEmptyBatch)
+
+	_, err = log.Append(&log_v1.Record{Value: []byte("first")})
+	require.NoError(t, err)
+
+	var records []*log_v1.Record
+	for i := 0; i < 5; i++ {
+		records = append(records, &log_v1.Record{
+			Value: []byte(fmt.Sprintf("record %d", i)),
+		})
+	}
+
+	first, last, err := log.AppendBatch(records)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), first)
+	require.Equal(t, uint64(5), last)
+
+	for i, record := range records {
+		read, err := log.Read(first + uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, record.Value, read.Value)
+	}
+}
+
+func testAppended(t *testing.T, log *Log) {
+	appended := log.Appended()
+	select {
+	case <-appended:
+		t.Fatal("notified before any append")
+	default:
+	}
+
+	done := make(chan uint64)
+	go func() {
+		<-appended
+		off, _ := log.HighestOffset()
+		done <- off
+	}()
+
+	off, err := log.Append(&log_v1.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	select {
+	case got := <-done:
+		require.Equal(t, off, got)
+	case <-time.After(time.Second):
+		t.Fatal("reader was not notified")
+	}
+
+	// the next append gets a new channel
+	select {
+	case <-log.Appended():
+		t.Fatal("notified before the next append")
+	default:
+	}
+}
+
+func testInfo(t *testing.T, log *Log) {
+	info, err := log.Info()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), info.LowestOffset)
+	require.Equal(t, uint64(0), info.NextOffset)
+	require.Len(t, info.Segments, 1)
+	require.True(t, info.LastAppend.IsZero())
+
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&log_v1.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Truncate(0))
+
+	info, err = log.Info()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), info.LowestOffset)
+	require.Equal(t, uint64(3), info.NextOffset)
+	require.False(t, info.LastAppend.IsZero())
+
+	var size uint64
+	for i, segment := range info.Segments {
+		size += segment.Size
+		if i > 0 {
+			require.Equal(t, info.Segments[i-1].NextOffset, segment.BaseOffset)
+		}
+	}
+	require.Equal(t, info.Size, size)
+	require.Equal(t, info.NextOffset, info.Segments[len(info.Segments)-1].NextOffset)
+}
+
 func testOutOfRangeErr(t *testing.T, log *Log) {
 	read, err := log.Read(1)
 	require.Nil(t, read)
-	require.Error(t, err)
+	require.Equal(t, ErrOffSetOutOfRange{Offset: 1, Low: 0, High: 0}, err)
+	require.False(t, err.(ErrOffSetOutOfRange).Behind())
+	require.Equal(t, "log: offset 1 out of range [0, 0)", err.Error())
+
+	_, err = log.Append(&log_v1.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	_, err = log.Append(&log_v1.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, log.Truncate(0))
+
+	_, err = log.Read(0)
+	require.Equal(t, ErrOffSetOutOfRange{Offset: 0, Low: 1, High: 2}, err)
+	require.True(t, err.(ErrOffSetOutOfRange).Behind())
 }
 
 func testReader(t *testing.T, log *Log) {
@@ -70,10 +181,43 @@ func testReader(t *testing.T, log *Log) {
 	b, err := io.ReadAll(reader)
 	require.NoError(t, err)
 
-	read := &log_v1.Record{}
-	err = proto.Unmarshal(b[binaryLengthWidth:], read)
+	records, err := unmarshalBatch(b[frameHeaderWidth:])
 	require.NoError(t, err)
-	require.Equal(t, record.Value, read.Value)
+	require.Len(t, records, 1)
+	require.Equal(t, record.Value, records[0].Value)
+}
+
+func testRecoverMissingIndex(t *testing.T, log *Log) {
+	record := &log_v1.Record{
+		Value: []byte("hello world"),
+	}
+
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(record)
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	indexes, err := filepath.Glob(filepath.Join(log.Dir, "*.index"))
+	require.NoError(t, err)
+	require.NotEmpty(t, indexes)
+	for _, index := range indexes {
+		require.NoError(t, os.Remove(index))
+	}
+
+	log, err = NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+
+	for i := uint64(0); i < 3; i++ {
+		read, err := log.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, i, read.Offset)
+		require.Equal(t, record.Value, read.Value)
+	}
+
+	off, err := log.Append(record)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
 }
 
 func testTruncate(t *testing.T, log *Log) {
@@ -92,3 +236,277 @@ func testTruncate(t *testing.T, log *Log) {
 	_, err = log.Read(0)
 	require.Error(t, err)
 }
+
+func TestLogAppendBatch(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-batch-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	for codec := CodecNone; codec <= CodecLZ4; codec++ {
+		log, err := NewLog(dir, c)
+		require.NoError(t, err)
+
+		var records []*log_v1.Record
+		for i := 0; i < 5; i++ {
+			records = append(records, &log_v1.Record{
+				Value: []byte(fmt.Sprintf("%s record %d", codec, i)),
+			})
+		}
+
+		first, last, err := log.AppendBatchWithCodec(records, codec)
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), first)
+		require.Equal(t, uint64(4), last)
+		// the batch is split across segments
+		require.Len(t, log.segments, 3)
+
+		// and survives reopening the log
+		require.NoError(t, log.Close())
+		log, err = NewLog(dir, c)
+		require.NoError(t, err)
+
+		for i, record := range records {
+			read, err := log.Read(first + uint64(i))
+			require.NoError(t, err)
+			require.Equal(t, first+uint64(i), read.Offset)
+			require.Equal(t, record.Value, read.Value)
+		}
+
+		require.NoError(t, log.Remove())
+		require.NoError(t, os.Mkdir(dir, 0755))
+	}
+}
+
+func TestLogAppendBatchMaxStoreBytes(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-batch-store-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 256
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Remove()
+
+	var records []*log_v1.Record
+	for i := 0; i < 20; i++ {
+		records = append(records, &log_v1.Record{
+			Value: bytes.Repeat([]byte{'a' + byte(i)}, 64),
+		})
+	}
+
+	first, last, err := log.AppendBatchWithCodec(records, CodecNone)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), first)
+	require.Equal(t, uint64(19), last)
+
+	// the batch is split before a segment's store outgrows its limit
+	require.Greater(t, len(log.segments), 1)
+	for _, s := range log.segments {
+		require.LessOrEqual(t, s.store.size, c.Segment.MaxStoreBytes)
+	}
+
+	for i, record := range records {
+		read, err := log.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, record.Value, read.Value)
+	}
+}
+
+func TestLogDurability(t *testing.T) {
+	for _, mode := range []SyncMode{SyncOS, SyncAlways, SyncBatch} {
+		dir, err := os.MkdirTemp("", "log-durability-test")
+		require.NoError(t, err)
+
+		c := Config{}
+		c.Durability.Mode = mode
+		log, err := NewLog(dir, c)
+		require.NoError(t, err)
+
+		_, err = log.Append(&log_v1.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+
+		// the record is out of the store's buffer once it is acknowledged
+		fi, err := os.Stat(log.activeSegment.store.Name())
+		require.NoError(t, err)
+		require.Equal(t, log.activeSegment.store.size, uint64(fi.Size()))
+
+		require.NoError(t, log.Remove())
+	}
+}
+
+func TestLogOffsetForTime(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-time-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2023, 9, 1, 2, 0, 0, 0, time.UTC)
+	c := Config{Now: func() time.Time { return now }}
+	c.Segment.MaxIndexBytes = entWidth * 3
+
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	// one record a minute, spread over several segments
+	start := now
+	for i := 0; i < 10; i++ {
+		_, err := log.Append(&log_v1.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		now = now.Add(time.Minute)
+	}
+	require.Greater(t, len(log.segments), 1)
+
+	for _, tt := range []struct {
+		at   time.Time
+		want uint64
+	}{
+		{at: start.Add(-time.Hour), want: 0},
+		{at: start, want: 0},
+		{at: start.Add(30 * time.Second), want: 1},
+		{at: start.Add(5 * time.Minute), want: 5},
+		{at: start.Add(9 * time.Minute), want: 9},
+	} {
+		off, err := log.OffsetForTime(tt.at)
+		require.NoError(t, err)
+		require.Equal(t, tt.want, off, tt.at)
+	}
+
+	_, err = log.OffsetForTime(now)
+	require.ErrorAs(t, err, &ErrOffSetOutOfRange{})
+
+	// lost time indexes are rebuilt from the stores
+	require.NoError(t, log.Close())
+	timeIndexes, err := filepath.Glob(filepath.Join(dir, "*.timeindex"))
+	require.NoError(t, err)
+	require.NotEmpty(t, timeIndexes)
+	for _, timeIndex := range timeIndexes {
+		require.NoError(t, os.Remove(timeIndex))
+	}
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	off, err := log.OffsetForTime(start.Add(5 * time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+	require.NoError(t, log.Close())
+}
+
+func TestLogResetWhileSyncing(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-sync-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Durability.Mode = SyncAlways
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				// appends must never sync a segment the reset closed
+				// in the meantime.
+				if _, err := log.Append(&log_v1.Record{Value: []byte("hello world")}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := uint64(1); i <= 100; i++ {
+		time.Sleep(time.Millisecond)
+		require.NoError(t, log.Reset(i*1000))
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestLogResetWhileReading(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-reset-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	defer log.Close()
+	_, err = log.Append(&log_v1.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				// the record is gone once the log is reset, but
+				// reading must never hit a closed segment.
+				_, err := log.Read(0)
+				if err != nil && !errors.As(err, &ErrOffSetOutOfRange{}) {
+					t.Error(err)
+					return
+				}
+				if _, err := log.Info(); err != nil {
+					t.Error(err)
+					return
+				}
+				log.Appended()
+			}
+		}()
+	}
+
+	for i := uint64(1); i <= 10; i++ {
+		require.NoError(t, log.Reset(i*10))
+		off, err := log.Append(&log_v1.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		require.Equal(t, i*10, off)
+	}
+	close(done)
+	wg.Wait()
+}
+
+func testClosed(t *testing.T, log *Log) {
+	_, err := log.Append(&log_v1.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	appended := log.Appended()
+	require.NoError(t, log.Close())
+	require.NoError(t, log.Close())
+
+	// readers waiting for records are woken up
+	select {
+	case <-appended:
+	default:
+		t.Fatal("readers not notified of the close")
+	}
+	<-log.Appended()
+
+	_, err = log.Append(&log_v1.Record{Value: []byte("hello world")})
+	require.ErrorIs(t, err, ErrClosed)
+	_, err = log.Read(0)
+	require.ErrorIs(t, err, ErrClosed)
+	_, err = log.Info()
+	require.ErrorIs(t, err, ErrClosed)
+	_, err = log.HighestOffset()
+	require.ErrorIs(t, err, ErrClosed)
+	require.ErrorIs(t, log.Truncate(0), ErrClosed)
+	_, err = io.ReadAll(log.Reader())
+	require.ErrorIs(t, err, ErrClosed)
+}
@@ -0,0 +1,477 @@
+package log
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errNotDir = errors.New("not a directory")
+
+// Op is an operation of a MemFS faults are injected into.
+type Op int
+
+const (
+	OpOpen Op = iota
+	OpWrite
+	OpSync
+	OpTruncate
+	OpRemove
+	OpRename
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpOpen:
+		return "open"
+	case OpWrite:
+		return "write"
+	case OpSync:
+		return "sync"
+	case OpTruncate:
+		return "truncate"
+	case OpRemove:
+		return "remove"
+	case OpRename:
+		return "rename"
+	default:
+		return "unknown"
+	}
+}
+
+// Fault makes an operation of a MemFS fail with Err. A failing write
+// writes its first N bytes before failing, like a short write.
+type Fault struct {
+	Err error
+	N   int
+}
+
+// MemFS is an FS keeping its files in memory, for tests. Faults can be
+// injected into its operations and Crash loses what was not synced, so
+// the log's error paths and recovery can be tested deterministically.
+// Creating, renaming and removing files is durable right away.
+type MemFS struct {
+	// Inject is called before every operation with the operation and
+	// the name of the file it applies to. The operation fails with
+	// the returned fault unless it is nil.
+	Inject func(op Op, name string) *Fault
+
+	mu    sync.Mutex
+	dirs  map[string]bool
+	files map[string]*memData
+	// gen is incremented by every crash, which closes the files
+	// opened before it.
+	gen int
+}
+
+type memData struct {
+	data    []byte
+	synced  []byte
+	modTime time.Time
+}
+
+// NewMemFS returns an empty MemFS.
+func NewMemFS() *MemFS {
+	return &MemFS{
+		dirs:  map[string]bool{"/": true, ".": true},
+		files: make(map[string]*memData),
+	}
+}
+
+// Crash brings every file back to its contents as of its last sync and
+// closes the open files, like a machine losing power.
+func (m *MemFS) Crash() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gen++
+	for _, d := range m.files {
+		d.data = append([]byte(nil), d.synced...)
+	}
+}
+
+// inject returns the fault injected into op, it must be called with
+// m.mu held.
+func (m *MemFS) inject(op Op, name string) *Fault {
+	if m.Inject == nil {
+		return nil
+	}
+	return m.Inject(op, name)
+}
+
+func (m *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	if f := m.inject(OpOpen, name); f != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: f.Err}
+	}
+
+	if m.dirs[name] {
+		return nil, &os.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+	}
+	if !m.dirs[filepath.Dir(name)] {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+
+	d, ok := m.files[name]
+	switch {
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case !ok:
+		d = &memData{modTime: time.Now()}
+		m.files[name] = d
+	}
+	if flag&os.O_TRUNC != 0 {
+		d.data = nil
+	}
+	return &memFile{fs: m, name: name, d: d, flag: flag, gen: m.gen}, nil
+}
+
+func (m *MemFS) Stat(name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	if m.dirs[name] {
+		return memFileInfo{name: filepath.Base(name), dir: true}, nil
+	}
+	if d, ok := m.files[name]; ok {
+		return d.info(name), nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+func (m *MemFS) ReadDir(name string) ([]os.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	if !m.dirs[name] {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: os.ErrNotExist}
+	}
+
+	var entries []os.DirEntry
+	for dir := range m.dirs {
+		if dir != name && filepath.Dir(dir) == name {
+			entries = append(entries, memDirEntry{memFileInfo{name: filepath.Base(dir), dir: true}})
+		}
+	}
+	for file, d := range m.files {
+		if filepath.Dir(file) == name {
+			entries = append(entries, memDirEntry{d.info(file)})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+func (m *MemFS) Mkdir(name string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	if m.dirs[name] || m.files[name] != nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	if !m.dirs[filepath.Dir(name)] {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrNotExist}
+	}
+	m.dirs[name] = true
+	return nil
+}
+
+func (m *MemFS) MkdirAll(name string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for dir := filepath.Clean(name); !m.dirs[dir]; dir = filepath.Dir(dir) {
+		if m.files[dir] != nil {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: errNotDir}
+		}
+		m.dirs[dir] = true
+	}
+	return nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	if f := m.inject(OpRemove, name); f != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: f.Err}
+	}
+
+	if _, ok := m.files[name]; ok {
+		delete(m.files, name)
+		return nil
+	}
+	if !m.dirs[name] {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	prefix := name + string(filepath.Separator)
+	for path := range m.files {
+		if strings.HasPrefix(path, prefix) {
+			return &os.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+		}
+	}
+	for dir := range m.dirs {
+		if strings.HasPrefix(dir, prefix) {
+			return &os.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+		}
+	}
+	delete(m.dirs, name)
+	return nil
+}
+
+func (m *MemFS) RemoveAll(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	if f := m.inject(OpRemove, name); f != nil {
+		return &os.PathError{Op: "removeall", Path: name, Err: f.Err}
+	}
+
+	prefix := name + string(filepath.Separator)
+	for path := range m.files {
+		if path == name || strings.HasPrefix(path, prefix) {
+			delete(m.files, path)
+		}
+	}
+	for dir := range m.dirs {
+		if dir == name || strings.HasPrefix(dir, prefix) {
+			delete(m.dirs, dir)
+		}
+	}
+	return nil
+}
+
+// Rename renames files, directories cannot be renamed.
+func (m *MemFS) Rename(oldName, newName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	oldName, newName = filepath.Clean(oldName), filepath.Clean(newName)
+	if f := m.inject(OpRename, oldName); f != nil {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: f.Err}
+	}
+
+	d, ok := m.files[oldName]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: os.ErrNotExist}
+	}
+	if m.dirs[newName] || !m.dirs[filepath.Dir(newName)] {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: os.ErrInvalid}
+	}
+	delete(m.files, oldName)
+	m.files[newName] = d
+	return nil
+}
+
+func (d *memData) info(name string) memFileInfo {
+	return memFileInfo{
+		name:    filepath.Base(name),
+		size:    int64(len(d.data)),
+		modTime: d.modTime,
+	}
+}
+
+// memFile is a file opened in a MemFS. Files keep working once removed
+// or renamed, as they do on Unix.
+type memFile struct {
+	fs   *MemFS
+	name string
+	d    *memData
+	flag int
+	gen  int
+	// off is where the next write goes unless the file is opened
+	// to append.
+	off    int64
+	closed bool
+}
+
+// check returns an error when the file can no longer be used, it must
+// be called with f.fs.mu held.
+func (f *memFile) check(op string) error {
+	if f.closed || f.gen != f.fs.gen {
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrClosed}
+	}
+	return nil
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("write"); err != nil {
+		return 0, err
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrPermission}
+	}
+
+	var err error
+	if fault := f.fs.inject(OpWrite, f.name); fault != nil {
+		if fault.N < len(p) {
+			p = p[:fault.N]
+		}
+		err = &os.PathError{Op: "write", Path: f.name, Err: fault.Err}
+	}
+
+	off := f.off
+	if f.flag&os.O_APPEND != 0 {
+		off = int64(len(f.d.data))
+	}
+	if end := off + int64(len(p)); end > int64(len(f.d.data)) {
+		f.d.resize(end)
+	}
+	n := copy(f.d.data[off:], p)
+	f.off = off + int64(n)
+	f.d.modTime = time.Now()
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("read"); err != nil {
+		return 0, err
+	}
+
+	if off >= int64(len(f.d.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.d.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("stat"); err != nil {
+		return nil, err
+	}
+	return f.d.info(f.name), nil
+}
+
+func (f *memFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("sync"); err != nil {
+		return err
+	}
+	return f.sync()
+}
+
+// sync commits the file's contents, it must be called with f.fs.mu
+// held.
+func (f *memFile) sync() error {
+	if fault := f.fs.inject(OpSync, f.name); fault != nil {
+		return &os.PathError{Op: "sync", Path: f.name, Err: fault.Err}
+	}
+	f.d.synced = append(f.d.synced[:0], f.d.data...)
+	return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("truncate"); err != nil {
+		return err
+	}
+	if fault := f.fs.inject(OpTruncate, f.name); fault != nil {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: fault.Err}
+	}
+
+	f.d.resize(size)
+	f.d.modTime = time.Now()
+	return nil
+}
+
+// Map returns the file's contents, which the returned bytes share as
+// long as the file is not grown past them.
+func (f *memFile) Map() ([]byte, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("mmap"); err != nil {
+		return nil, err
+	}
+	return f.d.data[:len(f.d.data):len(f.d.data)], nil
+}
+
+func (f *memFile) SyncMap() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("msync"); err != nil {
+		return err
+	}
+	return f.sync()
+}
+
+// Unmap is a no-op, the bytes Map returned are the file's contents.
+func (f *memFile) Unmap() error {
+	return nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("close"); err != nil {
+		return err
+	}
+	f.closed = true
+	return nil
+}
+
+// resize truncates or zero-extends the data to size bytes.
+func (d *memData) resize(size int64) {
+	n := int64(len(d.data))
+	if size <= int64(cap(d.data)) {
+		d.data = d.data[:size]
+		for i := n; i < size; i++ {
+			d.data[i] = 0
+		}
+		return
+	}
+	data := make([]byte, size)
+	copy(data, d.data)
+	d.data = data
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi memFileInfo) IsDir() bool        { return fi.dir }
+func (fi memFileInfo) Sys() interface{}   { return nil }
+
+func (fi memFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+type memDirEntry struct {
+	info memFileInfo
+}
+
+func (e memDirEntry) Name() string               { return e.info.Name() }
+func (e memDirEntry) IsDir() bool                { return e.info.IsDir() }
+func (e memDirEntry) Type() os.FileMode          { return e.info.Mode().Type() }
+func (e memDirEntry) Info() (os.FileInfo, error) { return e.info, nil }
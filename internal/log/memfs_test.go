@@ -0,0 +1,181 @@
+package log
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	log_v1 "github.com/reversearrow/distributed-computing-in-go/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemFS(t *testing.T) {
+	fs := NewMemFS()
+	require.NoError(t, fs.MkdirAll("/data/log", 0755))
+
+	f, err := fs.OpenFile("/data/log/0.store", os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("synced"))
+	require.NoError(t, err)
+	require.NoError(t, f.Sync())
+	_, err = f.Write([]byte(" lost"))
+	require.NoError(t, err)
+
+	b := make([]byte, 11)
+	_, err = f.ReadAt(b, 0)
+	require.NoError(t, err)
+	require.Equal(t, "synced lost", string(b))
+
+	entries, err := fs.ReadDir("/data/log")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "0.store", entries[0].Name())
+
+	fs.Crash()
+	_, err = f.Write([]byte("after the crash"))
+	require.Error(t, err)
+
+	fi, err := fs.Stat("/data/log/0.store")
+	require.NoError(t, err)
+	require.Equal(t, int64(len("synced")), fi.Size())
+
+	require.NoError(t, fs.Rename("/data/log/0.store", "/data/log/1.store"))
+	_, err = fs.Stat("/data/log/0.store")
+	require.True(t, errors.Is(err, os.ErrNotExist))
+	require.NoError(t, fs.RemoveAll("/data"))
+	_, err = fs.ReadDir("/data/log")
+	require.Error(t, err)
+}
+
+func TestLogCrash(t *testing.T) {
+	for mode, want := range map[SyncMode]uint64{
+		// only the appends synced to the store survive, the index
+		// is rebuilt from it.
+		SyncAlways: 3,
+		SyncOS:     0,
+	} {
+		fs := NewMemFS()
+		require.NoError(t, fs.MkdirAll("/log", 0755))
+		c := Config{FS: fs}
+		c.Durability.Mode = mode
+		log, err := NewLog("/log", c)
+		require.NoError(t, err)
+		for i := 0; i < 3; i++ {
+			_, err := log.Append(&log_v1.Record{Value: []byte("hello world")})
+			require.NoError(t, err)
+		}
+
+		fs.Crash()
+		log, err = NewLog("/log", c)
+		require.NoError(t, err)
+		for off := uint64(0); off < want; off++ {
+			got, err := log.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, off, got.Offset)
+		}
+		off, err := log.Append(&log_v1.Record{Value: []byte("after the crash")})
+		require.NoError(t, err)
+		require.Equal(t, want, off, mode)
+		require.NoError(t, log.Close())
+	}
+}
+
+func TestLogFaults(t *testing.T) {
+	errInjected := errors.New("injected")
+	storeFault := func(op Op, fault *Fault) func(Op, string) *Fault {
+		return func(o Op, name string) *Fault {
+			if o == op && strings.HasSuffix(name, ".store") {
+				return fault
+			}
+			return nil
+		}
+	}
+
+	t.Run("failed sync", func(t *testing.T) {
+		fs := NewMemFS()
+		require.NoError(t, fs.MkdirAll("/log", 0755))
+		c := Config{FS: fs}
+		c.Durability.Mode = SyncAlways
+		log, err := NewLog("/log", c)
+		require.NoError(t, err)
+		defer log.Close()
+
+		fs.Inject = storeFault(OpSync, &Fault{Err: errInjected})
+		_, err = log.Append(&log_v1.Record{Value: []byte("hello world")})
+		require.ErrorIs(t, err, errInjected)
+		fs.Inject = nil
+	})
+
+	t.Run("failed roll", func(t *testing.T) {
+		fs := NewMemFS()
+		require.NoError(t, fs.MkdirAll("/log", 0755))
+		c := Config{FS: fs}
+		c.Segment.MaxIndexBytes = entWidth * 2
+		log, err := NewLog("/log", c)
+		require.NoError(t, err)
+		defer log.Close()
+		_, err = log.Append(&log_v1.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+
+		// the batch fills the first segment and fails to open the next
+		fs.Inject = func(o Op, name string) *Fault {
+			if o == OpOpen && name == "/log/2.store" {
+				return &Fault{Err: errInjected}
+			}
+			return nil
+		}
+		_, _, err = log.AppendBatch([]*log_v1.Record{
+			{Value: []byte("first")},
+			{Value: []byte("second")},
+		})
+		require.ErrorIs(t, err, errInjected)
+		fs.Inject = nil
+
+		// none of the batch is left behind
+		high, err := log.HighestOffset()
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), high)
+		_, err = log.Read(1)
+		require.Error(t, err)
+
+		off, err := log.Append(&log_v1.Record{Value: []byte("after the fault")})
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), off)
+		got, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, []byte("after the fault"), got.Value)
+	})
+
+	t.Run("short write", func(t *testing.T) {
+		fs := NewMemFS()
+		require.NoError(t, fs.MkdirAll("/log", 0755))
+		c := Config{FS: fs}
+		c.Durability.Mode = SyncAlways
+		var repairs []Repair
+		c.Segment.Report = func(r Repair) { repairs = append(repairs, r) }
+		log, err := NewLog("/log", c)
+		require.NoError(t, err)
+		for i := 0; i < 2; i++ {
+			_, err := log.Append(&log_v1.Record{Value: []byte("hello world")})
+			require.NoError(t, err)
+		}
+
+		// half a frame header makes it to the store
+		fs.Inject = storeFault(OpWrite, &Fault{Err: errInjected, N: 6})
+		_, err = log.Append(&log_v1.Record{Value: []byte("torn")})
+		require.ErrorIs(t, err, errInjected)
+		fs.Inject = nil
+		require.Error(t, log.Close())
+
+		log, err = NewLog("/log", c)
+		require.NoError(t, err)
+		defer log.Close()
+		// the last complete frame is indexed again, as its batch may
+		// only be partly indexed.
+		require.Equal(t, []Repair{{Store: "/log/0.store", Reindexed: 1, Truncated: 6}}, repairs)
+		off, err := log.Append(&log_v1.Record{Value: []byte("after the fault")})
+		require.NoError(t, err)
+		require.Equal(t, uint64(2), off)
+	})
+}
@@ -0,0 +1,40 @@
+package log
+
+import "fmt"
+
+// RebuildIndexes rebuilds the index and time index of every segment of
+// the log stored in dir from the records of its store, for when they
+// were lost or no longer match it. The log must not be open.
+func RebuildIndexes(dir string, c Config) ([]Repair, error) {
+	c.setDefaults()
+	// the repairs of opening the segments are part of the rebuild
+	c.Segment.Report = nil
+
+	segments, _, err := ListSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var repairs []Repair
+	for _, files := range segments {
+		// an index without a store has nothing to be rebuilt from
+		if files.Store == "" {
+			continue
+		}
+
+		s, err := newSegment(dir, files.BaseOffset, c)
+		if err != nil {
+			return repairs, err
+		}
+		r, err := s.rebuildIndex()
+		if err != nil {
+			s.Close()
+			return repairs, fmt.Errorf("rebuilding segment %d: %w", files.BaseOffset, err)
+		}
+		if err := s.Close(); err != nil {
+			return repairs, err
+		}
+		repairs = append(repairs, r)
+	}
+	return repairs, nil
+}
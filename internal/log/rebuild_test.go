@@ -0,0 +1,54 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log_v1 "github.com/reversearrow/distributed-computing-in-go/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRebuildIndexes(t *testing.T) {
+	dir, err := os.MkdirTemp("", "rebuild-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	start := time.Now()
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&log_v1.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	// an index overwritten with garbage and a lost time index
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "0.index"), []byte("not an index"), 0644))
+	require.NoError(t, os.Remove(filepath.Join(dir, "3.timeindex")))
+
+	repairs, err := RebuildIndexes(dir, c)
+	require.NoError(t, err)
+	require.Len(t, repairs, 2)
+	require.Equal(t, uint64(3), repairs[0].Reindexed)
+	require.Equal(t, uint64(2), repairs[1].Reindexed)
+
+	problems, err := Verify(dir)
+	require.NoError(t, err)
+	require.Empty(t, problems)
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for off := uint64(0); off < 5; off++ {
+		got, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, got.Offset)
+	}
+	off, err := log.OffsetForTime(start)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+}
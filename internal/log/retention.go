@@ -0,0 +1,71 @@
+package log
+
+import "time"
+
+const (
+	defaultRetentionInterval = time.Minute
+)
+
+// startRetention runs the retention policy of the log in the
+// background when one is configured.
+func startRetention(l *Log) *job {
+	c := l.Config.Retention
+	if c.MaxAge == 0 && c.MaxBytes == 0 {
+		return startJob(0, nil)
+	}
+
+	interval := c.Interval
+	if interval == 0 {
+		interval = defaultRetentionInterval
+	}
+
+	return startJob(interval, func() {
+		removed, err := l.EnforceRetention()
+		if c.Report != nil && (len(removed) > 0 || err != nil) {
+			c.Report(removed, err)
+		}
+	})
+}
+
+// EnforceRetention removes the closed segments that fall outside
+// Config.Retention and returns them. Segments are removed oldest first
+// so the log never has gaps.
+func (l *Log) EnforceRetention() ([]SegmentInfo, error) {
+	l.cleaner.Lock()
+	defer l.cleaner.Unlock()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil, ErrClosed
+	}
+
+	c := l.Config.Retention
+	now := l.Config.now()
+
+	var total uint64
+	for _, s := range l.segments {
+		total += s.store.size
+	}
+
+	var removed []SegmentInfo
+	for len(l.segments) > 1 {
+		s := l.segments[0]
+		info := s.Info()
+
+		expired := c.MaxAge > 0 && now.Sub(info.LastAppend) > c.MaxAge
+		oversized := c.MaxBytes > 0 && total > c.MaxBytes
+		if !expired && !oversized {
+			break
+		}
+
+		if err := s.Remove(); err != nil {
+			return removed, err
+		}
+		l.segments = l.segments[1:]
+		total -= info.Size
+		removed = append(removed, info)
+	}
+
+	return removed, nil
+}
@@ -0,0 +1,161 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	log_v1 "github.com/reversearrow/distributed-computing-in-go/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// testClock is a clock tests move forward by hand.
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestRetention(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, log *Log, clock *testClock){
+		"max age removes expired segments":  testRetentionMaxAge,
+		"max bytes removes oldest segments": testRetentionMaxBytes,
+		"active segment is never removed":   testRetentionKeepsActiveSegment,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "retention-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			clock := &testClock{now: time.Date(2023, 9, 1, 2, 0, 0, 0, time.UTC)}
+			c := Config{Now: clock.Now}
+			c.Segment.MaxIndexBytes = entWidth * 3
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+
+			// 3 closed segments a minute apart and an active one
+			for i := 0; i < 10; i++ {
+				_, err := log.Append(&log_v1.Record{Value: []byte("hello world")})
+				require.NoError(t, err)
+				if i%3 == 2 {
+					clock.Add(time.Minute)
+				}
+			}
+			require.Len(t, log.segments, 4)
+
+			fn(t, log, clock)
+		})
+	}
+}
+
+func testRetentionMaxAge(t *testing.T, log *Log, clock *testClock) {
+	log.Config.Retention.MaxAge = 90 * time.Second
+
+	removed, err := log.EnforceRetention()
+	require.NoError(t, err)
+	require.Len(t, removed, 2)
+	require.Equal(t, uint64(0), removed[0].BaseOffset)
+	require.Equal(t, uint64(3), removed[1].BaseOffset)
+	require.Equal(t, uint64(6), removed[1].NextOffset)
+
+	_, err = log.Read(5)
+	require.Error(t, err)
+	read, err := log.Read(6)
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), read.Offset)
+
+	files, err := filepath.Glob(filepath.Join(log.Dir, "3.*"))
+	require.NoError(t, err)
+	require.Empty(t, files)
+
+	clock.Add(time.Minute)
+	removed, err = log.EnforceRetention()
+	require.NoError(t, err)
+	require.Len(t, removed, 1)
+	require.Len(t, log.segments, 1)
+}
+
+func testRetentionMaxBytes(t *testing.T, log *Log, clock *testClock) {
+	var total uint64
+	for _, s := range log.segments {
+		total += s.store.size
+	}
+	log.Config.Retention.MaxBytes = total - log.segments[0].store.size
+
+	removed, err := log.EnforceRetention()
+	require.NoError(t, err)
+	require.Len(t, removed, 1)
+	require.Equal(t, uint64(0), removed[0].BaseOffset)
+
+	removed, err = log.EnforceRetention()
+	require.NoError(t, err)
+	require.Empty(t, removed)
+}
+
+func testRetentionKeepsActiveSegment(t *testing.T, log *Log, clock *testClock) {
+	log.Config.Retention.MaxAge = time.Nanosecond
+	log.Config.Retention.MaxBytes = 1
+	clock.Add(time.Hour)
+
+	removed, err := log.EnforceRetention()
+	require.NoError(t, err)
+	require.Len(t, removed, 3)
+	require.Len(t, log.segments, 1)
+	require.Same(t, log.activeSegment, log.segments[0])
+
+	read, err := log.Read(9)
+	require.NoError(t, err)
+	require.Equal(t, uint64(9), read.Offset)
+}
+
+func TestRetentionRunsInBackground(t *testing.T) {
+	dir, err := os.MkdirTemp("", "retention-background-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	reports := make(chan []SegmentInfo, 1)
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth
+	c.Retention.MaxBytes = 1
+	c.Retention.Interval = time.Millisecond
+	c.Retention.Report = func(removed []SegmentInfo, err error) {
+		if err != nil {
+			t.Errorf("retention failed: %v", err)
+		}
+		select {
+		case reports <- removed:
+		default:
+		}
+	}
+
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&log_v1.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	select {
+	case removed := <-reports:
+		require.NotEmpty(t, removed)
+	case <-time.After(5 * time.Second):
+		t.Fatal("retention did not run")
+	}
+
+	require.NoError(t, log.Close())
+}
@@ -4,10 +4,16 @@ import (
 	"errors"
 	"fmt"
 	log_v1 "github.com/reversearrow/distributed-computing-in-go/api/v1"
+	"google.golang.org/protobuf/encoding/protowire"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 	"io"
+	"math"
 	"os"
 	"path"
+	"sort"
+	"sync"
+	"time"
 )
 
 var (
@@ -24,8 +30,15 @@ var (
 type segment struct {
 	store                  *store
 	index                  *index
+	timeIndex              *timeIndex
 	baseOffset, nextOffset uint64
 	config                 Config
+
+	cache struct {
+		mu      sync.Mutex
+		pos     uint64
+		records [][]byte
+	}
 }
 
 func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
@@ -33,11 +46,12 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 		baseOffset: baseOffset,
 		config:     c,
 	}
-	if _, err := os.Stat(dir); err != nil {
+	fs := c.fs()
+	if _, err := fs.Stat(dir); err != nil {
 		return nil, fmt.Errorf("error opening directory %s: %w", dir, err)
 	}
 
-	storeFile, err := os.OpenFile(
+	storeFile, err := fs.OpenFile(
 		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store")),
 		os.O_CREATE|os.O_RDWR|os.O_APPEND,
 		0644,
@@ -50,7 +64,7 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 		return nil, fmt.Errorf("failed to create store file: %w", err)
 	}
 
-	indexFile, err := os.OpenFile(
+	indexFile, err := fs.OpenFile(
 		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")),
 		os.O_RDWR|os.O_CREATE|os.O_APPEND,
 		0644,
@@ -63,26 +77,303 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 		return nil, fmt.Errorf("faile to open new index file: %w", err)
 	}
 
+	timeIndexFile, err := fs.OpenFile(
+		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".timeindex")),
+		os.O_RDWR|os.O_CREATE|os.O_APPEND,
+		0644,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open time index file: %w", err)
+	}
+
+	idx, err := newIndex(timeIndexFile, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open new time index file: %w", err)
+	}
+	s.timeIndex = &timeIndex{idx}
+
+	r, err := s.repair()
+	if err != nil {
+		return nil, fmt.Errorf("failed to recover segment %d: %w", baseOffset, err)
+	}
+	if c.Segment.Report != nil && r.repaired() {
+		c.Segment.Report(r)
+	}
+
+	if err := s.loadNextOffset(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// loadNextOffset sets the segment's next offset from its last index
+// entry.
+func (s *segment) loadNextOffset() error {
 	off, _, err := s.index.Read(-1)
 	switch err {
 	case nil:
-		s.nextOffset = baseOffset + uint64(off) + 1
+		s.nextOffset = s.baseOffset + uint64(off) + 1
 	case io.EOF:
-		s.nextOffset = baseOffset
+		s.nextOffset = s.baseOffset
 	default:
-		return nil, errUnexpectedIndexReadError
+		return errUnexpectedIndexReadError
 	}
+	return nil
+}
 
-	return s, nil
+// Repair describes how the files of a segment were brought back in line
+// with its store when the segment was opened.
+type Repair struct {
+	// Store is the path of the segment's store.
+	Store string
+	// Rebuilt is set when the index entries did not match the records
+	// of the store, and the index was rebuilt from scratch.
+	Rebuilt bool
+	// Reindexed is the number of records whose index entries were
+	// rebuilt from the store.
+	Reindexed uint64
+	// Truncated is the number of bytes of torn writes removed from
+	// the end of the store.
+	Truncated uint64
+}
+
+func (r Repair) repaired() bool {
+	return r.Rebuilt || r.Reindexed > 0 || r.Truncated > 0
+}
+
+func (r Repair) String() string {
+	msg := fmt.Sprintf("%s: reindexed %d records", r.Store, r.Reindexed)
+	if r.Rebuilt {
+		msg += " after the index did not match the store"
+	}
+	if r.Truncated > 0 {
+		msg += fmt.Sprintf(", truncated %d bytes of torn writes", r.Truncated)
+	}
+	return msg
+}
+
+// repair brings the index and the store back in line after an unclean
+// shutdown. Index entries are kept as long as they point at complete
+// frames, complete frames from the last indexed one onwards are indexed
+// again and whatever is left at the tail of the store is a torn write
+// and is truncated. Offsets only have to be ascending, as compacted
+// segments have gaps.
+func (s *segment) repair() (Repair, error) {
+	r := Repair{Store: s.store.Name()}
+	var (
+		entries uint64
+		end     uint64
+		// relative offset following the last valid entry
+		next uint64
+		// position, first entry and next relative offset of the
+		// last frame covered by the index.
+		last, lastEntry, lastNext uint64
+		// whether an entry points at a frame not holding its record
+		mismatched bool
+	)
+
+	// the index is pre-grown, so it may hold zeroed entries when it
+	// was not closed properly.
+	n := s.index.size
+	if n > uint64(len(s.index.mmap)) {
+		n = uint64(len(s.index.mmap))
+	}
+	for ; entries < n/entWidth; entries++ {
+		off, pos, err := s.index.Read(int64(entries))
+		if err != nil || uint64(off) < next {
+			break
+		}
+
+		// records of a batch share the frame of the batch
+		if entries > 0 && pos == last {
+			next = uint64(off) + 1
+			continue
+		}
+
+		if pos != end {
+			break
+		}
+		size, err := s.store.frameSize(pos)
+		if err != nil {
+			break
+		}
+		// the positions of a stale or corrupt index may still line
+		// up with the frames, so the offset of the first entry of
+		// every frame is checked against the frame's records.
+		if s.misindexed(entries) {
+			mismatched = true
+			break
+		}
+		last, lastEntry, lastNext, end = pos, entries, next, pos+size
+		next = uint64(off) + 1
+	}
+
+	// the last entry may point past the records of its frame's batch
+	if mismatched || entries > 0 && s.misindexed(entries-1) {
+		entries, end, next = 0, 0, 0
+		s.timeIndex.size = 0
+		r.Rebuilt = true
+	}
+
+	// the last frame's batch may only be partly indexed.
+	if entries > 0 {
+		entries, end, next = lastEntry, last, lastNext
+	}
+	s.index.size = entries * entWidth
+	indexed := entries
+
+	// the time index entries lost after the last valid one are
+	// rebuilt from the store, starting at the frame that entry points
+	// into.
+	s.timeIndex.repair(uint32(next))
+	var from uint64
+	if off, _, err := s.timeIndex.Read(-1); err == nil {
+		if _, pos, err := s.index.Search(off); err == nil {
+			from = pos
+		}
+	}
+	err := s.scan(from, end, func(_ uint64, _ Codec, records []*log_v1.Record) error {
+		return s.indexTime(records)
+	})
+	if err != nil {
+		return r, err
+	}
+
+	for end < s.store.size {
+		p, err := s.store.Read(end)
+		if err != nil {
+			break
+		}
+
+		records, err := unmarshalBatch(p)
+		if err != nil || !s.ascending(records, s.baseOffset+next) {
+			break
+		}
+
+		for _, record := range records {
+			if err := s.index.Write(uint32(record.Offset-s.baseOffset), end); err != nil {
+				return r, fmt.Errorf("rebuilding index entry for offset %d: %w", record.Offset, err)
+			}
+			indexed++
+		}
+		if err := s.indexTime(records); err != nil {
+			return r, err
+		}
+		next = records[len(records)-1].Offset - s.baseOffset + 1
+		end += uint64(len(p)) + frameHeaderWidth
+	}
+	r.Reindexed = indexed - entries
+
+	if end < s.store.size {
+		r.Truncated = s.store.size - end
+		return r, s.store.truncate(end)
+	}
+	return r, nil
+}
+
+// misindexed reports whether the k-th index entry points at a frame
+// that does not hold its record. Frames that cannot be read are left
+// for reads to report as corrupt.
+func (s *segment) misindexed(k uint64) bool {
+	off, pos, err := s.index.Read(int64(k))
+	if err != nil {
+		return true
+	}
+
+	p, err := s.store.Read(pos)
+	if err != nil {
+		return false
+	}
+	records, err := decodeBatch(p)
+	if err != nil {
+		return false
+	}
+	_, err = findRecord(records, s.baseOffset+uint64(off))
+	return err != nil
+}
+
+// rebuildIndex drops the index and time index and rebuilds them from
+// the store.
+func (s *segment) rebuildIndex() (Repair, error) {
+	s.index.size = 0
+	s.timeIndex.size = 0
+	r, err := s.repair()
+	if err != nil {
+		return r, err
+	}
+	return r, s.loadNextOffset()
+}
+
+// ascending reports whether the records hold ascending offsets, none
+// below from, that fit in the segment's index.
+func (s *segment) ascending(records []*log_v1.Record, from uint64) bool {
+	if len(records) == 0 {
+		return false
+	}
+
+	for _, record := range records {
+		if record.Offset < from || record.Offset-s.baseOffset > math.MaxUint32 {
+			return false
+		}
+		from = record.Offset + 1
+	}
+	return true
+}
+
+// scan calls fn with the position, codec and records of every frame
+// stored between from and to.
+func (s *segment) scan(from, to uint64, fn func(pos uint64, c Codec, records []*log_v1.Record) error) error {
+	for pos := from; pos < to; {
+		p, err := s.store.Read(pos)
+		if err != nil {
+			return err
+		}
+
+		records, err := unmarshalBatch(p)
+		if err != nil {
+			return fmt.Errorf("decoding batch at pos %d: %w", pos, err)
+		}
+
+		if err := fn(pos, frameCodec(p), records); err != nil {
+			return err
+		}
+		pos += uint64(len(p)) + frameHeaderWidth
+	}
+	return nil
 }
 
 // Append writes the record to the segment and returns' newly appended
 // records' offset.
 func (s *segment) Append(record *log_v1.Record) (offset uint64, err error) {
-	record.Offset = s.nextOffset
-	p, err := proto.Marshal(record)
+	return s.AppendBatch([]*log_v1.Record{record}, s.config.Codec)
+}
+
+// AppendBatch writes the records to the segment as a single frame
+// compressed with the codec and returns the last record's offset.
+// Records are stamped with their offset and append time.
+func (s *segment) AppendBatch(records []*log_v1.Record, c Codec) (offset uint64, err error) {
+	now := s.config.now()
+	for i, record := range records {
+		record.Offset = s.nextOffset + uint64(i)
+		record.AppendTime = timestamppb.New(now)
+	}
+
+	return s.write(records, c, 0)
+}
+
+// write stores the records, which already carry their offsets, as a
+// single frame compressed with the codec, along with the raft index of
+// replicated logs. Every record gets its own index entry pointing at
+// the frame.
+func (s *segment) write(records []*log_v1.Record, c Codec, index uint64) (offset uint64, err error) {
+	if uint64(len(records)) > s.capacity() {
+		return 0, io.EOF
+	}
+
+	p, err := encodeBatch(records, c, index)
 	if err != nil {
-		return 0, fmt.Errorf("error marshalling record: %w", err)
+		return 0, err
 	}
 
 	_, pos, err := s.store.Append(p)
@@ -90,48 +381,279 @@ func (s *segment) Append(record *log_v1.Record) (offset uint64, err error) {
 		return 0, err
 	}
 
-	if err := s.index.Write(
-		uint32(s.nextOffset-s.baseOffset),
-		pos,
-	); err != nil {
+	for _, record := range records {
+		if err := s.index.Write(
+			uint32(record.Offset-s.baseOffset),
+			pos,
+		); err != nil {
+			return 0, err
+		}
+		s.nextOffset = record.Offset + 1
+	}
+
+	if err := s.indexTime(records); err != nil {
 		return 0, err
 	}
 
-	s.nextOffset++
-	return record.Offset, nil
+	return s.nextOffset - 1, nil
 }
 
-// Read returns record for the given offset.
+// truncate removes the records from off onwards and makes off the
+// segment's next offset. The records stored in the same frame as off
+// but below it are written again as a frame of their own.
+func (s *segment) truncate(off uint64) error {
+	if off >= s.nextOffset {
+		return nil
+	}
+	if off < s.baseOffset {
+		off = s.baseOffset
+	}
+	rel := uint32(off - s.baseOffset)
+
+	var (
+		kept  []*log_v1.Record
+		codec Codec
+		index uint64
+	)
+	if _, pos, err := s.index.Search(rel); err == nil {
+		p, err := s.store.Read(pos)
+		if err != nil {
+			return err
+		}
+		records, err := unmarshalBatch(p)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			if record.Offset < off {
+				kept = append(kept, record)
+			}
+		}
+		codec = frameCodec(p)
+		if index, err = batchIndex(p); err != nil {
+			return err
+		}
+
+		// entries are sorted by position as well, the frame's
+		// first entry is the first one pointing at it.
+		n := int(s.index.size / entWidth)
+		first := sort.Search(n, func(k int) bool {
+			_, at, _ := s.index.Read(int64(k))
+			return at >= pos
+		})
+		s.index.size = uint64(first) * entWidth
+		if err := s.store.truncate(pos); err != nil {
+			return err
+		}
+	}
+	s.timeIndex.repair(rel)
+
+	s.cache.mu.Lock()
+	s.cache.records = nil
+	s.cache.mu.Unlock()
+
+	if len(kept) > 0 {
+		if _, err := s.write(kept, codec, index); err != nil {
+			return err
+		}
+	}
+	s.nextOffset = off
+	return nil
+}
+
+// lastIndex returns the raft index written with the segment's last
+// batch, 0 when the segment holds none.
+func (s *segment) lastIndex() (uint64, error) {
+	_, pos, err := s.index.Read(-1)
+	if errors.Is(err, io.EOF) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	p, err := s.store.Read(pos)
+	if err != nil {
+		return 0, err
+	}
+	return batchIndex(p)
+}
+
+// indexTime adds the append time of a batch to the time index.
+func (s *segment) indexTime(records []*log_v1.Record) error {
+	if len(records) == 0 || records[0].AppendTime == nil {
+		return nil
+	}
+
+	return s.timeIndex.Write(
+		uint32(records[0].Offset-s.baseOffset),
+		records[0].AppendTime.AsTime(),
+	)
+}
+
+// OffsetForTime returns the offset of the first record appended at or
+// after t, and false when every record in the segment is older.
+func (s *segment) OffsetForTime(t time.Time) (uint64, bool) {
+	off, ok := s.timeIndex.Lookup(t)
+	if !ok {
+		return 0, false
+	}
+	return s.baseOffset + uint64(off), true
+}
+
+// capacity returns the number of records the index can still hold.
+func (s *segment) capacity() uint64 {
+	return (uint64(len(s.index.mmap)) - s.index.size) / entWidth
+}
+
+// fit returns how many of the records go in the segment's next frame:
+// as many as the index can hold and, judging by their uncompressed size,
+// the store can hold before it reaches MaxStoreBytes. An empty segment
+// takes at least one record, so records larger than a segment are still
+// written.
+func (s *segment) fit(records []*log_v1.Record) uint64 {
+	n := s.capacity()
+	if n > uint64(len(records)) {
+		n = uint64(len(records))
+	}
+
+	size := s.store.size + frameHeaderWidth + codecWidth
+	for i := uint64(0); i < n; i++ {
+		size += uint64(protowire.SizeTag(batchRecordsField) +
+			protowire.SizeBytes(proto.Size(records[i])+stampWidth))
+		if size > s.config.Segment.MaxStoreBytes {
+			if i == 0 && s.store.size == 0 {
+				return 1
+			}
+			return i
+		}
+	}
+	return n
+}
+
+// Read returns record for the given offset. When the offset has been
+// compacted away, the next record of the segment is returned instead
+// and io.EOF when there is none.
 func (s *segment) Read(off uint64) (*log_v1.Record, error) {
-	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+	rel, pos, err := s.index.Search(uint32(off - s.baseOffset))
 	if err != nil {
 		return nil, fmt.Errorf("attmpeting to read value at the pos: %v : %w", pos, err)
 	}
+	off = s.baseOffset + uint64(rel)
 
-	p, err := s.store.Read(pos)
+	records, err := s.readBatch(pos)
+	var corrupt ErrCorruptRecord
+	if errors.As(err, &corrupt) {
+		corrupt.Offset, corrupt.Segment = off, s.baseOffset
+		return nil, corrupt
+	}
 	if err != nil {
 		return nil, fmt.Errorf("attempting to read from the store at pos: %v: %w", pos, err)
 	}
+
+	return findRecord(records, off)
+}
+
+// readBatch returns the marshalled records of the batch stored at pos.
+// The last batch read is kept around, so reading the records of a
+// compressed batch one after the other decompresses it only once.
+func (s *segment) readBatch(pos uint64) ([][]byte, error) {
+	s.cache.mu.Lock()
+	defer s.cache.mu.Unlock()
+	if s.cache.records != nil && s.cache.pos == pos {
+		return s.cache.records, nil
+	}
+
+	p, err := s.store.Read(pos)
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := decodeBatch(p)
+	if err != nil {
+		return nil, err
+	}
+	s.cache.pos, s.cache.records = pos, records
+	return records, nil
+}
+
+// findRecord unmarshals the record at off from a batch. Offsets in a
+// batch are contiguous, so its position is derived from the first one.
+func findRecord(records [][]byte, off uint64) (*log_v1.Record, error) {
+	if len(records) == 0 {
+		return nil, fmt.Errorf("offset %d not found in empty batch", off)
+	}
+
 	record := &log_v1.Record{}
-	if err := proto.Unmarshal(p, record); err != nil {
+	if err := proto.Unmarshal(records[0], record); err != nil {
 		return nil, err
 	}
 
-	return record, nil
+	if i := off - record.Offset; off >= record.Offset && i < uint64(len(records)) {
+		if err := proto.Unmarshal(records[i], record); err != nil {
+			return nil, err
+		}
+		if record.Offset == off {
+			return record, nil
+		}
+	}
+
+	for _, p := range records {
+		if err := proto.Unmarshal(p, record); err != nil {
+			return nil, err
+		}
+		if record.Offset == off {
+			return record, nil
+		}
+	}
+	return nil, fmt.Errorf("offset %d not found in batch", off)
+}
+
+// SegmentInfo describes a segment of the log.
+type SegmentInfo struct {
+	BaseOffset uint64
+	// NextOffset is the offset the next record appended to the
+	// segment gets.
+	NextOffset uint64
+	// Size is the number of bytes held by the segment's store.
+	Size uint64
+	// LastAppend is when the last record was appended, the store's
+	// modification time when the time index is empty.
+	LastAppend time.Time
+}
+
+// Info returns the description of the segment.
+func (s *segment) Info() SegmentInfo {
+	info := SegmentInfo{
+		BaseOffset: s.baseOffset,
+		NextOffset: s.nextOffset,
+		Size:       s.store.size,
+	}
+
+	if ms, ok := s.timeIndex.last(); ok {
+		info.LastAppend = time.UnixMilli(int64(ms))
+	} else if fi, err := s.store.Stat(); err == nil {
+		info.LastAppend = fi.ModTime()
+	}
+	return info
 }
 
 // IsMaxed is used to know if service needs to create a new segment.
 func (s *segment) IsMaxed() bool {
 	return s.store.size >= s.config.Segment.MaxStoreBytes ||
-		s.index.size >= s.config.Segment.MaxIndexBytes
+		s.index.size+entWidth > s.config.Segment.MaxIndexBytes
 }
 
-// Close closes the index and store files.
+// Close closes the index, time index and store files.
 func (s *segment) Close() error {
 	if err := s.index.Close(); err != nil {
 		return err
 	}
 
+	if err := s.timeIndex.Close(); err != nil {
+		return err
+	}
+
 	if err := s.store.Close(); err != nil {
 		return err
 	}
@@ -139,17 +661,26 @@ func (s *segment) Close() error {
 	return nil
 }
 
-// Remove closes and removes index and store files.
+// Remove closes and removes index, time index and store files.
 func (s *segment) Remove() error {
 	if err := s.Close(); err != nil {
 		return err
 	}
+	return s.remove()
+}
+
+// remove removes the files of a closed segment.
+func (s *segment) remove() error {
+	fs := s.config.fs()
+	if err := fs.Remove(s.index.Name()); err != nil {
+		return err
+	}
 
-	if err := os.Remove(s.index.Name()); err != nil {
+	if err := fs.Remove(s.timeIndex.Name()); err != nil {
 		return err
 	}
 
-	if err := os.Remove(s.store.Name()); err != nil {
+	if err := fs.Remove(s.store.Name()); err != nil {
 		return err
 	}
 
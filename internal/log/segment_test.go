@@ -3,9 +3,13 @@ package log
 import (
 	log_v1 "github.com/reversearrow/distributed-computing-in-go/api/v1"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 	"io"
 	"os"
+	"path"
 	"testing"
+	"time"
 )
 
 func TestSegment(t *testing.T) {
@@ -55,3 +59,366 @@ func TestSegment(t *testing.T) {
 	require.False(t, s.IsMaxed())
 
 }
+
+func TestSegmentCorruptRecord(t *testing.T) {
+	dir, err := os.MkdirTemp("", "segment-corrupt-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+
+	want := &log_v1.Record{Value: []byte("hello world")}
+	for i := 0; i < 3; i++ {
+		_, err = s.Append(want)
+		require.NoError(t, err)
+	}
+
+	_, pos, err := s.index.Read(1)
+	require.NoError(t, err)
+
+	// the store is flushed before it is read so the frame is on disk
+	_, err = s.Read(16)
+	require.NoError(t, err)
+
+	f, err := os.OpenFile(s.store.Name(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff}, int64(pos+frameHeaderWidth+1))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	_, err = s.Read(17)
+	var corrupt ErrCorruptRecord
+	require.ErrorAs(t, err, &corrupt)
+	require.Equal(t, uint64(17), corrupt.Offset)
+	require.Equal(t, pos, corrupt.Position)
+	require.Equal(t, s.store.Name(), corrupt.File)
+
+	got, err := s.Read(18)
+	require.NoError(t, err)
+	require.Equal(t, want.Value, got.Value)
+
+	require.NoError(t, s.Remove())
+}
+
+func TestSegmentRecovery(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	// frames and index entries written by a cleanly closed segment
+	storeBytes, indexBytes := writeSegmentFiles(t, c, 16, 3)
+	var ends []uint64
+	for i := uint64(1); i <= 3; i++ {
+		if i < 3 {
+			ends = append(ends, enc.Uint64(indexBytes[i*entWidth+offsetWidth:]))
+			continue
+		}
+		ends = append(ends, uint64(len(storeBytes)))
+	}
+
+	complete := func(size uint64) (n uint64) {
+		for _, end := range ends {
+			if end <= size {
+				n++
+			}
+		}
+		return n
+	}
+
+	t.Run("torn store", func(t *testing.T) {
+		for cut := 0; cut <= len(storeBytes); cut++ {
+			want := complete(uint64(cut))
+			testRecoveredSegment(t, c, storeBytes[:cut], indexBytes, want)
+		}
+	})
+
+	t.Run("torn index", func(t *testing.T) {
+		for cut := 0; cut <= len(indexBytes); cut++ {
+			testRecoveredSegment(t, c, storeBytes, indexBytes[:cut], 3)
+		}
+	})
+
+	t.Run("pre-grown index", func(t *testing.T) {
+		for cut := 0; cut <= len(indexBytes); cut++ {
+			padded := make([]byte, c.Segment.MaxIndexBytes)
+			copy(padded, indexBytes[:cut])
+			testRecoveredSegment(t, c, storeBytes, padded, 3)
+		}
+	})
+
+	t.Run("mismatched index", func(t *testing.T) {
+		// the entries still point at the frames, the last one with
+		// the wrong offset.
+		mismatched := append([]byte(nil), indexBytes...)
+		enc.PutUint32(mismatched[2*entWidth:], 7)
+
+		var repairs []Repair
+		c := c
+		c.Segment.Report = func(r Repair) { repairs = append(repairs, r) }
+		testRecoveredSegment(t, c, storeBytes, mismatched, 3)
+		require.Len(t, repairs, 1)
+		require.True(t, repairs[0].Rebuilt)
+		require.Equal(t, uint64(3), repairs[0].Reindexed)
+	})
+
+	t.Run("mismatched middle entry", func(t *testing.T) {
+		// a compacted segment holding 16, 18 and 19, whose index
+		// has the second entry point at its frame with offset 17.
+		dir, err := os.MkdirTemp("", "segment-mismatched")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		var repairs []Repair
+		c := c
+		c.Segment.Report = func(r Repair) { repairs = append(repairs, r) }
+		s, err := newSegment(dir, 16, c)
+		require.NoError(t, err)
+		for _, off := range []uint64{16, 18, 19} {
+			_, err := s.write([]*log_v1.Record{{Offset: off}}, CodecNone, 0)
+			require.NoError(t, err)
+		}
+		require.NoError(t, s.Close())
+		indexBytes, err := os.ReadFile(s.index.Name())
+		require.NoError(t, err)
+		enc.PutUint32(indexBytes[entWidth:], 1)
+		require.NoError(t, os.WriteFile(s.index.Name(), indexBytes, 0644))
+
+		s, err = newSegment(dir, 16, c)
+		require.NoError(t, err)
+		require.Len(t, repairs, 1)
+		require.True(t, repairs[0].Rebuilt)
+		require.Equal(t, uint64(3), repairs[0].Reindexed)
+		for _, off := range []uint64{16, 18, 19} {
+			got, err := s.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, off, got.Offset)
+		}
+		require.NoError(t, s.Remove())
+	})
+}
+
+// writeSegmentFiles appends n records to a new segment, closes it and
+// returns the contents of its store and index files.
+func writeSegmentFiles(t *testing.T, c Config, baseOffset uint64, n int) ([]byte, []byte) {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "segment-files")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := newSegment(dir, baseOffset, c)
+	require.NoError(t, err)
+	for i := 0; i < n; i++ {
+		_, err = s.Append(&log_v1.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.Close())
+
+	storeBytes, err := os.ReadFile(s.store.Name())
+	require.NoError(t, err)
+	indexBytes, err := os.ReadFile(s.index.Name())
+	require.NoError(t, err)
+	return storeBytes, indexBytes
+}
+
+// testRecoveredSegment opens a segment from the given file contents and
+// checks that exactly want records survived and that it accepts appends.
+func testRecoveredSegment(t *testing.T, c Config, storeBytes, indexBytes []byte, want uint64) {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "segment-recovery")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, os.WriteFile(path.Join(dir, "16.store"), storeBytes, 0644))
+	require.NoError(t, os.WriteFile(path.Join(dir, "16.index"), indexBytes, 0644))
+
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.Equal(t, 16+want, s.nextOffset)
+	require.Equal(t, want*entWidth, s.index.size)
+
+	for off := uint64(16); off < s.nextOffset; off++ {
+		got, err := s.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, got.Offset)
+	}
+
+	off, err := s.Append(&log_v1.Record{Value: []byte("after recovery")})
+	require.NoError(t, err)
+	require.Equal(t, 16+want, off)
+
+	got, err := s.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, []byte("after recovery"), got.Value)
+
+	require.NoError(t, s.Remove())
+}
+
+func TestSegmentRecoversPartlyIndexedBatch(t *testing.T) {
+	dir, err := os.MkdirTemp("", "segment-batch-recovery")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	_, err = s.Append(&log_v1.Record{Value: []byte("single")})
+	require.NoError(t, err)
+	_, err = s.AppendBatch([]*log_v1.Record{
+		{Value: []byte("first")},
+		{Value: []byte("second")},
+		{Value: []byte("third")},
+	}, CodecSnappy)
+	require.NoError(t, err)
+
+	// only the first record of the batch made it to the index
+	s.index.size = 2 * entWidth
+	require.NoError(t, s.Close())
+
+	s, err = newSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(20), s.nextOffset)
+
+	got, err := s.Read(19)
+	require.NoError(t, err)
+	require.Equal(t, []byte("third"), got.Value)
+	require.NoError(t, s.Remove())
+}
+
+func TestSegmentRecoversTimeIndexTail(t *testing.T) {
+	dir, err := os.MkdirTemp("", "segment-time-recovery")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2023, 9, 1, 2, 0, 0, 0, time.UTC)
+	c := Config{Now: func() time.Time { return now }}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	start := now
+	for i := 0; i < 3; i++ {
+		_, err := s.Append(&log_v1.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		now = now.Add(time.Minute)
+	}
+
+	// only the first entry of the time index made it to disk
+	s.timeIndex.size = entWidth
+	require.NoError(t, s.Close())
+
+	s, err = newSegment(dir, 16, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		off, ok := s.OffsetForTime(start.Add(time.Duration(i) * time.Minute))
+		require.True(t, ok)
+		require.Equal(t, uint64(16+i), off)
+	}
+	require.NoError(t, s.Remove())
+}
+
+func TestSegmentLegacyFrames(t *testing.T) {
+	dir, err := os.MkdirTemp("", "segment-legacy-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+
+	// stores written before batches hold one marshalled record per
+	// frame, the first one marshals to nothing at all.
+	legacy := []*log_v1.Record{
+		{Offset: 0},
+		{Offset: 1, Value: []byte("legacy")},
+	}
+	for _, record := range legacy {
+		p, err := proto.Marshal(record)
+		require.NoError(t, err)
+		_, pos, err := s.store.Append(p)
+		require.NoError(t, err)
+		require.NoError(t, s.index.Write(uint32(record.Offset), pos))
+	}
+	require.NoError(t, s.Close())
+
+	s, err = newSegment(dir, 0, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), s.nextOffset)
+
+	off, err := s.AppendBatch([]*log_v1.Record{
+		{Value: []byte("batched")},
+	}, CodecSnappy)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+
+	for off, want := range []string{"", "legacy", "batched"} {
+		got, err := s.Read(uint64(off))
+		require.NoError(t, err)
+		require.Equal(t, uint64(off), got.Offset)
+		require.Equal(t, want, string(got.Value))
+	}
+
+	// truncating into a legacy frame keeps the records before it
+	require.NoError(t, s.truncate(1))
+	got, err := s.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), got.Offset)
+	require.NoError(t, s.Remove())
+}
+
+func TestSegmentRecordMetadata(t *testing.T) {
+	dir, err := os.MkdirTemp("", "segment-metadata-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	appendTime := time.Date(2023, 9, 1, 2, 0, 0, 0, time.UTC)
+	c := Config{Now: func() time.Time { return appendTime }}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+
+	want := &log_v1.Record{
+		Key:   []byte("user-42"),
+		Value: []byte("hello world"),
+		Headers: []*log_v1.Header{
+			{Key: "trace-id", Value: "abc"},
+			{Key: "content-type", Value: "application/json"},
+		},
+		Timestamp: timestamppb.New(appendTime.Add(-time.Second)),
+	}
+	off, err := s.Append(want)
+	require.NoError(t, err)
+
+	got, err := s.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, want.Key, got.Key)
+	require.Len(t, got.Headers, 2)
+	for i, h := range want.Headers {
+		require.Equal(t, h.Key, got.Headers[i].Key)
+		require.Equal(t, h.Value, got.Headers[i].Value)
+	}
+	require.True(t, want.Timestamp.AsTime().Equal(got.Timestamp.AsTime()))
+	require.True(t, appendTime.Equal(got.AppendTime.AsTime()))
+
+	// records of a batch share the append time but not the message
+	batch := []*log_v1.Record{{Value: []byte("first")}, {Value: []byte("second")}}
+	_, err = s.AppendBatch(batch, CodecNone)
+	require.NoError(t, err)
+	require.NotSame(t, batch[0].AppendTime, batch[1].AppendTime)
+	require.True(t, appendTime.Equal(batch[1].AppendTime.AsTime()))
+
+	require.NoError(t, s.Remove())
+}
@@ -4,12 +4,15 @@ import (
 	"bufio"
 	"encoding/binary"
 	"fmt"
-	"os"
+	"hash/crc32"
 	"sync"
 )
 
 var (
 	enc = binary.BigEndian
+
+	// crcTable is the Castagnoli table used to checksum every frame.
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
 )
 
 const (
@@ -19,17 +22,53 @@ const (
 	// additional bytes written, in addition to the actual
 	// data stored in the buffer.
 	binaryLengthWidth = 8
+
+	// checksumWidth is the width of the CRC32C checksum stored
+	// right after the length prefix.
+	checksumWidth = 4
+
+	// frameHeaderWidth is the number of bytes written in front
+	// of every record: its length followed by its checksum.
+	frameHeaderWidth = binaryLengthWidth + checksumWidth
 )
 
+// ErrCorruptRecord is returned when a frame read from the store does
+// not match its checksum or its header points past the end of the file.
+type ErrCorruptRecord struct {
+	// Offset of the record and base offset of its segment, filled in
+	// once the frame is resolved through the index.
+	Offset  uint64
+	Segment uint64
+	// Position of the frame in the store file.
+	Position uint64
+	// File is the name of the store file.
+	File string
+	// Expected and Actual hold the stored and computed checksums.
+	Expected, Actual uint32
+}
+
+func (e ErrCorruptRecord) Error() string {
+	if e.Expected == e.Actual {
+		return fmt.Sprintf(
+			"corrupt record at offset %d: frame at pos %d in %s exceeds the file size",
+			e.Offset, e.Position, e.File,
+		)
+	}
+	return fmt.Sprintf(
+		"corrupt record at offset %d: checksum mismatch at pos %d in %s: expected %08x, got %08x",
+		e.Offset, e.Position, e.File, e.Expected, e.Actual,
+	)
+}
+
 type store struct {
-	*os.File
+	File
 	mu   sync.Mutex
 	buf  *bufio.Writer
 	size uint64
 }
 
-func newStore(f *os.File) (*store, error) {
-	fi, err := os.Stat(f.Name())
+func newStore(f File) (*store, error) {
+	fi, err := f.Stat()
 	if err != nil {
 		return nil, err
 	}
@@ -46,8 +85,12 @@ func (s *store) Append(p []byte) (uint64, uint64, error) {
 	defer s.mu.Unlock()
 
 	pos := s.size
-	// this writes the size of the data in binary
-	if err := binary.Write(s.buf, enc, uint64(len(p))); err != nil {
+	// this writes the size of the data in binary, followed by
+	// the checksum of the data.
+	header := make([]byte, frameHeaderWidth)
+	enc.PutUint64(header[:binaryLengthWidth], uint64(len(p)))
+	enc.PutUint32(header[binaryLengthWidth:], crc32.Checksum(p, crcTable))
+	if _, err := s.buf.Write(header); err != nil {
 		return 0, 0, err
 	}
 
@@ -56,7 +99,7 @@ func (s *store) Append(p []byte) (uint64, uint64, error) {
 		return 0, 0, err
 	}
 
-	w += binaryLengthWidth
+	w += frameHeaderWidth
 	s.size += uint64(w)
 
 	// returns number of bytes written, pos and error
@@ -70,18 +113,78 @@ func (s *store) Read(pos uint64) ([]byte, error) {
 		return nil, err
 	}
 
-	size := make([]byte, binaryLengthWidth)
-	if _, err := s.File.ReadAt(size, int64(pos)); err != nil {
+	if pos+frameHeaderWidth > s.size {
+		return nil, ErrCorruptRecord{Position: pos, File: s.Name()}
+	}
+
+	header := make([]byte, frameHeaderWidth)
+	if _, err := s.File.ReadAt(header, int64(pos)); err != nil {
 		return nil, fmt.Errorf("reading file error: %w", err)
 	}
 
-	b := make([]byte, enc.Uint64(size))
-	if _, err := s.File.ReadAt(b, int64(pos+binaryLengthWidth)); err != nil {
+	size := enc.Uint64(header[:binaryLengthWidth])
+	if size > s.size-pos-frameHeaderWidth {
+		return nil, ErrCorruptRecord{Position: pos, File: s.Name()}
+	}
+
+	b := make([]byte, size)
+	if _, err := s.File.ReadAt(b, int64(pos+frameHeaderWidth)); err != nil {
 		return nil, err
 	}
+
+	expected := enc.Uint32(header[binaryLengthWidth:])
+	if actual := crc32.Checksum(b, crcTable); actual != expected {
+		return nil, ErrCorruptRecord{
+			Position: pos,
+			File:     s.Name(),
+			Expected: expected,
+			Actual:   actual,
+		}
+	}
 	return b, nil
 }
 
+// frameSize returns the width of the frame stored at pos, header
+// included, without verifying its checksum. It fails when the frame
+// is not entirely contained in the store.
+func (s *store) frameSize(pos uint64) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return 0, err
+	}
+
+	if pos+frameHeaderWidth > s.size {
+		return 0, ErrCorruptRecord{Position: pos, File: s.Name()}
+	}
+
+	header := make([]byte, binaryLengthWidth)
+	if _, err := s.File.ReadAt(header, int64(pos)); err != nil {
+		return 0, err
+	}
+
+	size := enc.Uint64(header)
+	if size > s.size-pos-frameHeaderWidth {
+		return 0, ErrCorruptRecord{Position: pos, File: s.Name()}
+	}
+	return size + frameHeaderWidth, nil
+}
+
+// truncate drops everything stored from size onwards.
+func (s *store) truncate(size uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+
+	if err := s.File.Truncate(int64(size)); err != nil {
+		return err
+	}
+	s.size = size
+	return nil
+}
+
 func (s *store) ReadAt(p []byte, off int64) (int, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -93,6 +196,24 @@ func (s *store) ReadAt(p []byte, off int64) (int, error) {
 	return s.File.ReadAt(p, off)
 }
 
+// Flush writes the buffered frames to the file.
+func (s *store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Flush()
+}
+
+// Sync writes the buffered frames to the file and commits the file
+// to stable storage.
+func (s *store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	return s.File.Sync()
+}
+
 func (s *store) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
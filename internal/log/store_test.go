@@ -2,6 +2,7 @@ package log
 
 import (
 	"github.com/stretchr/testify/require"
+	"hash/crc32"
 	"os"
 	"testing"
 )
@@ -13,7 +14,7 @@ const (
 
 var (
 	write         = []byte("hello world")
-	expectedWidth = uint64(len(write)) + binaryLengthWidth
+	expectedWidth = uint64(len(write)) + frameHeaderWidth
 )
 
 func TestStoreAppendRead(t *testing.T) {
@@ -29,7 +30,7 @@ func TestStoreAppendRead(t *testing.T) {
 		}
 	}(f.Name())
 
-	s, err := newStore(f)
+	s, err := newStore(&osFile{File: f})
 	require.NoError(t, err)
 	t.Log("new store created")
 
@@ -44,7 +45,7 @@ func testAppend(t *testing.T, s *store) {
 		n, pos, err := s.Append(write)
 		require.NoError(t, err)
 		require.Equal(t, expectedWidth, n)
-		require.Equal(t, expectedWidth*i, pos)
+		require.Equal(t, expectedWidth*(i-1), pos)
 	}
 }
 
@@ -60,18 +61,60 @@ func testRead(t *testing.T, s *store) {
 func testReadAt(t *testing.T, s *store) {
 	t.Helper()
 	for i, off := uint64(1), int64(0); i < 4; i++ {
-		b := make([]byte, binaryLengthWidth)
+		b := make([]byte, frameHeaderWidth)
 		n, err := s.ReadAt(b, off)
 		require.NoError(t, err)
-		require.Equal(t, binaryLengthWidth, n)
+		require.Equal(t, frameHeaderWidth, n)
 		off += int64(n)
 
-		size := enc.Uint64(b)
+		size := enc.Uint64(b[:binaryLengthWidth])
+		checksum := enc.Uint32(b[binaryLengthWidth:])
 		b = make([]byte, size)
 		n, err = s.ReadAt(b, off)
 		require.NoError(t, err)
 		require.Equal(t, write, b)
+		require.Equal(t, crc32.Checksum(write, crcTable), checksum)
 		require.Equal(t, int(size), n)
 		off += int64(n)
 	}
 }
+
+func TestStoreCorruption(t *testing.T) {
+	f, err := os.CreateTemp(os.TempDir(), "store_corruption_test")
+	require.NoError(t, err)
+	defer func(name string) {
+		err := os.Remove(name)
+		if err != nil {
+			t.Logf("error removing the file: %v\n", err)
+		}
+	}(f.Name())
+
+	s, err := newStore(&osFile{File: f})
+	require.NoError(t, err)
+
+	_, pos, err := s.Append(write)
+	require.NoError(t, err)
+	_, err = s.Read(pos)
+	require.NoError(t, err)
+
+	// flip a bit in the payload of the frame
+	_, err = f.WriteAt([]byte{write[0] ^ 0x01}, int64(pos+frameHeaderWidth))
+	require.NoError(t, err)
+
+	_, err = s.Read(pos)
+	var corrupt ErrCorruptRecord
+	require.ErrorAs(t, err, &corrupt)
+	require.Equal(t, pos, corrupt.Position)
+	require.Equal(t, f.Name(), corrupt.File)
+	require.NotEqual(t, corrupt.Expected, corrupt.Actual)
+
+	// a length prefix pointing past the end of the file
+	header := make([]byte, binaryLengthWidth)
+	enc.PutUint64(header, 1<<40)
+	_, err = f.WriteAt(header, int64(pos))
+	require.NoError(t, err)
+
+	_, err = s.Read(pos)
+	require.ErrorAs(t, err, &corrupt)
+	require.Equal(t, pos, corrupt.Position)
+}
@@ -0,0 +1,77 @@
+package log
+
+import (
+	"io"
+	"sort"
+	"time"
+)
+
+// timeIndex maps append times to the offsets appended from then on. It
+// shares the layout of index, with the position replaced by the append
+// time in milliseconds since the epoch. An entry is only written when
+// the append time moves forward, so entries are sorted by both offset
+// and time.
+type timeIndex struct {
+	*index
+}
+
+// Write records that the record at offset, relative to the segment's
+// base offset, was appended at t.
+func (i *timeIndex) Write(offset uint32, t time.Time) error {
+	ms := uint64(t.UnixMilli())
+	if last, ok := i.last(); ok && ms <= last {
+		return nil
+	}
+	return i.index.Write(offset, ms)
+}
+
+// Lookup returns the relative offset of the first record appended at or
+// after t, with millisecond precision.
+func (i *timeIndex) Lookup(t time.Time) (uint32, bool) {
+	ms := uint64(t.UnixMilli())
+	n := int(i.size / entWidth)
+	k := sort.Search(n, func(k int) bool {
+		_, at, _ := i.Read(int64(k))
+		return at >= ms
+	})
+	if k == n {
+		return 0, false
+	}
+
+	off, _, _ := i.Read(int64(k))
+	return off, true
+}
+
+// last returns the time of the last entry.
+func (i *timeIndex) last() (uint64, bool) {
+	_, ms, err := i.Read(-1)
+	if err == io.EOF {
+		return 0, false
+	}
+	return ms, err == nil
+}
+
+// repair keeps the entries that are sorted and point below next, the
+// number of records the segment holds.
+func (i *timeIndex) repair(next uint32) {
+	n := i.size
+	if n > uint64(len(i.mmap)) {
+		n = uint64(len(i.mmap))
+	}
+
+	var entries uint64
+	for ; entries < n/entWidth; entries++ {
+		off, ms, err := i.Read(int64(entries))
+		if err != nil || off >= next {
+			break
+		}
+
+		if entries > 0 {
+			prevOff, prevMs, _ := i.Read(int64(entries - 1))
+			if off <= prevOff || ms <= prevMs {
+				break
+			}
+		}
+	}
+	i.size = entries * entWidth
+}
@@ -0,0 +1,56 @@
+package log
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeIndex(t *testing.T) {
+	f, err := os.CreateTemp(os.TempDir(), "timeindex_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+
+	idx, err := newIndex(&osFile{File: f}, c)
+	require.NoError(t, err)
+	ti := &timeIndex{idx}
+
+	_, ok := ti.Lookup(time.Unix(0, 0))
+	require.False(t, ok)
+
+	start := time.Date(2023, 9, 1, 2, 0, 0, 0, time.UTC)
+	require.NoError(t, ti.Write(0, start))
+	// the append time did not move forward
+	require.NoError(t, ti.Write(1, start))
+	require.NoError(t, ti.Write(2, start.Add(-time.Minute)))
+	require.NoError(t, ti.Write(3, start.Add(time.Minute)))
+	require.NoError(t, ti.Write(5, start.Add(time.Hour)))
+	require.Equal(t, 3*entWidth, ti.size)
+
+	for _, tt := range []struct {
+		at   time.Time
+		want uint32
+		ok   bool
+	}{
+		{at: start.Add(-time.Hour), want: 0, ok: true},
+		{at: start, want: 0, ok: true},
+		{at: start.Add(time.Second), want: 3, ok: true},
+		{at: start.Add(time.Minute), want: 3, ok: true},
+		{at: start.Add(time.Hour), want: 5, ok: true},
+		{at: start.Add(2 * time.Hour), ok: false},
+	} {
+		off, ok := ti.Lookup(tt.at)
+		require.Equal(t, tt.ok, ok, tt.at)
+		require.Equal(t, tt.want, off, tt.at)
+	}
+
+	// entries pointing past the records of the segment are dropped
+	ti.repair(5)
+	require.Equal(t, 2*entWidth, ti.size)
+	require.NoError(t, ti.Close())
+}
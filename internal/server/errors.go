@@ -0,0 +1,191 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"syscall"
+
+	"github.com/reversearrow/distributed-computing-in-go/internal/group"
+	"github.com/reversearrow/distributed-computing-in-go/internal/log"
+	"github.com/reversearrow/distributed-computing-in-go/internal/topic"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrorDomain is the domain of the errdetails.ErrorInfo the server
+// attaches to its errors.
+const ErrorDomain = "log.v1"
+
+// The reasons of the errdetails.ErrorInfo the server attaches to its
+// errors.
+const (
+	// ReasonOffsetAhead is given for offsets not appended yet,
+	// consumers wait for them to be.
+	ReasonOffsetAhead = "OFFSET_AHEAD"
+	// ReasonOffsetBehind is given for offsets removed by retention,
+	// consumers restart from the low watermark.
+	ReasonOffsetBehind = "OFFSET_BEHIND"
+	// ReasonNotLeader is given for writes that reached a follower.
+	ReasonNotLeader = "NOT_LEADER"
+	// ReasonCorruptRecord is given for records stored in a frame that
+	// failed its checksum.
+	ReasonCorruptRecord = "CORRUPT_RECORD"
+)
+
+// The metadata keys of the errdetails.ErrorInfo the server attaches to
+// its errors.
+const (
+	MetadataOffset        = "offset"
+	MetadataLowWatermark  = "low_watermark"
+	MetadataHighWatermark = "high_watermark"
+	MetadataLeader        = "leader"
+	MetadataSegment       = "segment"
+)
+
+const locale = "en-US"
+
+// errorStatus returns err as a status error with a code and details
+// clients can act on. Status errors are returned as they are.
+func errorStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	var outOfRange log.ErrOffSetOutOfRange
+	if errors.As(err, &outOfRange) {
+		return outOfRangeStatus(err, outOfRange)
+	}
+
+	var notLeader log.ErrNotLeader
+	if errors.As(err, &notLeader) {
+		st := status.New(codes.Unavailable, err.Error())
+		return withDetails(st,
+			&errdetails.ErrorInfo{
+				Reason:   ReasonNotLeader,
+				Domain:   ErrorDomain,
+				Metadata: map[string]string{MetadataLeader: notLeader.Leader},
+			},
+			"This server is not the leader, send the request to the leader.",
+		)
+	}
+
+	var corrupt log.ErrCorruptRecord
+	if errors.As(err, &corrupt) {
+		st := status.New(codes.DataLoss, err.Error())
+		return withDetails(st,
+			&errdetails.ErrorInfo{
+				Reason: ReasonCorruptRecord,
+				Domain: ErrorDomain,
+				Metadata: map[string]string{
+					MetadataOffset:  strconv.FormatUint(corrupt.Offset, 10),
+					MetadataSegment: strconv.FormatUint(corrupt.Segment, 10),
+				},
+			},
+			"The requested record is corrupt on the server.",
+		)
+	}
+
+	return status.Error(code(err), err.Error())
+}
+
+func outOfRangeStatus(err error, outOfRange log.ErrOffSetOutOfRange) error {
+	reason := ReasonOffsetAhead
+	msg := "The requested offset has not been written yet."
+	if outOfRange.Behind() {
+		reason = ReasonOffsetBehind
+		msg = "The requested offset was removed from the log."
+	}
+
+	st := status.New(codes.OutOfRange, err.Error())
+	return withDetails(st,
+		&errdetails.ErrorInfo{
+			Reason: reason,
+			Domain: ErrorDomain,
+			Metadata: map[string]string{
+				MetadataOffset:        strconv.FormatUint(outOfRange.Offset, 10),
+				MetadataLowWatermark:  strconv.FormatUint(outOfRange.Low, 10),
+				MetadataHighWatermark: strconv.FormatUint(outOfRange.High, 10),
+			},
+		},
+		msg,
+	)
+}
+
+// withDetails attaches the error info and a localized message to st.
+func withDetails(st *status.Status, info *errdetails.ErrorInfo, msg string) error {
+	d, err := st.WithDetails(info, &errdetails.LocalizedMessage{
+		Locale:  locale,
+		Message: msg,
+	})
+	if err != nil {
+		return st.Err()
+	}
+	return d.Err()
+}
+
+// code returns the status code of errors without details.
+func code(err error) codes.Code {
+	switch {
+	case errors.Is(err, topic.ErrTopicNotFound),
+		errors.Is(err, topic.ErrPartitionNotFound),
+		errors.Is(err, group.ErrNoCommittedOffset),
+		errors.Is(err, group.ErrUnknownMember):
+		return codes.NotFound
+	case errors.Is(err, topic.ErrTopicExists):
+		return codes.AlreadyExists
+	case errors.Is(err, topic.ErrInvalidName),
+		errors.Is(err, topic.ErrTooManyPartitions),
+		errors.Is(err, group.ErrInvalidGroup),
+		errors.Is(err, group.ErrNoTopics),
+		errors.Is(err, log.ErrEmptyBatch),
+		errors.Is(err, errNoCommitLog),
+		errors.Is(err, errNoRecord):
+		return codes.InvalidArgument
+	case errors.Is(err, group.ErrStaleGeneration),
+		errors.Is(err, group.ErrNotAssigned),
+		errors.Is(err, group.ErrInconsistentStrategy):
+		return codes.FailedPrecondition
+	case errors.Is(err, log.ErrFull),
+		errors.Is(err, syscall.ENOSPC):
+		return codes.ResourceExhausted
+	case errors.Is(err, errNoTopics),
+		errors.Is(err, errNoGroups):
+		return codes.Unimplemented
+	case errors.Is(err, log.ErrClosed),
+		errors.Is(err, errStopping):
+		return codes.Unavailable
+	case errors.Is(err, context.Canceled):
+		return codes.Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return codes.DeadlineExceeded
+	default:
+		return codes.Unknown
+	}
+}
+
+// statusUnary returns the errors of unary calls as status errors.
+func statusUnary(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	res, err := handler(ctx, req)
+	return res, errorStatus(err)
+}
+
+// statusStream returns the errors of streaming calls as status errors.
+func statusStream(
+	srv interface{},
+	stream grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	return errorStatus(handler(srv, stream))
+}
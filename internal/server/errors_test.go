@@ -0,0 +1,95 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/reversearrow/distributed-computing-in-go/internal/log"
+	"github.com/reversearrow/distributed-computing-in-go/internal/topic"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestErrorStatus(t *testing.T) {
+	for _, tc := range []struct {
+		err      error
+		code     codes.Code
+		reason   string
+		metadata map[string]string
+	}{{
+		err:    log.ErrOffSetOutOfRange{Offset: 12, Low: 3, High: 12},
+		code:   codes.OutOfRange,
+		reason: ReasonOffsetAhead,
+		metadata: map[string]string{
+			MetadataOffset:        "12",
+			MetadataLowWatermark:  "3",
+			MetadataHighWatermark: "12",
+		},
+	}, {
+		err:    fmt.Errorf("reading: %w", log.ErrOffSetOutOfRange{Offset: 1, Low: 3, High: 12}),
+		code:   codes.OutOfRange,
+		reason: ReasonOffsetBehind,
+		metadata: map[string]string{
+			MetadataOffset:        "1",
+			MetadataLowWatermark:  "3",
+			MetadataHighWatermark: "12",
+		},
+	}, {
+		err:      log.ErrNotLeader{Leader: "127.0.0.1:8400"},
+		code:     codes.Unavailable,
+		reason:   ReasonNotLeader,
+		metadata: map[string]string{MetadataLeader: "127.0.0.1:8400"},
+	}, {
+		err:    fmt.Errorf("reading: %w", log.ErrCorruptRecord{Offset: 18, Segment: 16, File: "16.store"}),
+		code:   codes.DataLoss,
+		reason: ReasonCorruptRecord,
+		metadata: map[string]string{
+			MetadataOffset:  "18",
+			MetadataSegment: "16",
+		},
+	}, {
+		err:  fmt.Errorf("%w: 16", log.ErrFull),
+		code: codes.ResourceExhausted,
+	}, {
+		err:  &os.PathError{Op: "write", Path: "16.store", Err: syscall.ENOSPC},
+		code: codes.ResourceExhausted,
+	}, {
+		err:  fmt.Errorf("%w: orders", topic.ErrTopicNotFound),
+		code: codes.NotFound,
+	}, {
+		err:  fmt.Errorf("%w: 100000, at most 256", topic.ErrTooManyPartitions),
+		code: codes.InvalidArgument,
+	}, {
+		err:  topic.ErrTopicExists,
+		code: codes.AlreadyExists,
+	}, {
+		err:  log.ErrEmptyBatch,
+		code: codes.InvalidArgument,
+	}, {
+		err:  status.Error(codes.PermissionDenied, "denied"),
+		code: codes.PermissionDenied,
+	}} {
+		st := status.Convert(errorStatus(tc.err))
+		require.Equal(t, tc.code, st.Code(), tc.err)
+		require.Equal(t, status.Convert(tc.err).Message(), st.Message())
+		if tc.reason == "" {
+			require.Empty(t, st.Details())
+			continue
+		}
+
+		require.Len(t, st.Details(), 2)
+		info := st.Details()[0].(*errdetails.ErrorInfo)
+		require.Equal(t, tc.reason, info.Reason)
+		require.Equal(t, ErrorDomain, info.Domain)
+		require.Equal(t, tc.metadata, info.Metadata)
+		msg := st.Details()[1].(*errdetails.LocalizedMessage)
+		require.Equal(t, "en-US", msg.Locale)
+		require.NotEmpty(t, msg.Message)
+	}
+
+	require.NoError(t, errorStatus(nil))
+}
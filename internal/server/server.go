@@ -2,12 +2,78 @@ package server
 
 import (
 	"context"
+	"errors"
+	"time"
+
 	log_v1 "github.com/reversearrow/distributed-computing-in-go/api/v1"
+	"github.com/reversearrow/distributed-computing-in-go/internal/auth"
+	"github.com/reversearrow/distributed-computing-in-go/internal/group"
 	"github.com/reversearrow/distributed-computing-in-go/internal/log"
+	"github.com/reversearrow/distributed-computing-in-go/internal/topic"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var (
+	errNoCommitLog = errors.New("server: no default log, a topic is required")
+	errNoTopics    = errors.New("server: topics are not enabled")
+	errNoGroups    = errors.New("server: consumer groups are not enabled")
+	errStopping    = errors.New("server: stopping")
+	errNoRecord    = errors.New("server: missing record")
+)
+
+// The actions authorized on topics.
+const (
+	produceAction = "produce"
+	consumeAction = "consume"
+	manageAction  = "manage"
 )
 
+// SubjectMetadataKey is the metadata key clients connecting without TLS
+// name themselves with. Clients connecting with TLS are named by the
+// common name of their certificate.
+const SubjectMetadataKey = "subject"
+
+// CommitLog is a log the server serves, either a local log.Log or a
+// replicated log.DistributedLog.
+type CommitLog interface {
+	AppendBatch(records []*log_v1.Record) (first, last uint64, err error)
+	AppendBatchWithCodec(records []*log_v1.Record, c log.Codec) (first, last uint64, err error)
+	Read(off uint64) (*log_v1.Record, error)
+	OffsetForTime(t time.Time) (uint64, error)
+	Appended() <-chan struct{}
+	Info() (log.Info, error)
+}
+
+// GetServerer returns the servers of the cluster.
+type GetServerer interface {
+	GetServers() ([]*log_v1.Server, error)
+}
+
+// Authorizer permits subjects to take actions on objects.
+type Authorizer interface {
+	Authorize(subject, object, action string) error
+}
+
+// Config holds the logs served. CommitLog serves the requests without
+// a topic, Topics the ones with a topic. Offsets keeps the offsets
+// committed by consumer groups and Coordinator their members.
+// GetServerer lists the servers of the cluster, none are listed when
+// it is nil and clients resolve the server to itself. Authorizer
+// permits callers to produce to, consume from and manage topics, every
+// call is permitted when it is nil. Closing Done ends the consume
+// streams waiting for records, so they do not hold up a graceful stop.
 type Config struct {
-	CommitLog log.Log
+	CommitLog   CommitLog
+	Topics      *topic.Registry
+	Offsets     *group.Offsets
+	Coordinator *group.Coordinator
+	GetServerer GetServerer
+	Authorizer  Authorizer
+	Done        <-chan struct{}
 }
 
 var _ log_v1.LogServer = (*grpcServer)(nil)
@@ -17,6 +83,23 @@ type grpcServer struct {
 	*Config
 }
 
+// NewGRPCServer returns a gRPC server serving the log service. The
+// server's transport security is set among opts, e.g. mutual TLS with
+// grpc.Creds(credentials.NewTLS(tlsConfig)).
+func NewGRPCServer(config *Config, opts ...grpc.ServerOption) (*grpc.Server, error) {
+	opts = append(opts,
+		grpc.ChainUnaryInterceptor(authenticate, statusUnary),
+		grpc.ChainStreamInterceptor(authenticateStream, statusStream),
+	)
+	gsrv := grpc.NewServer(opts...)
+	srv, err := newgrpcServer(config)
+	if err != nil {
+		return nil, err
+	}
+	log_v1.RegisterLogServer(gsrv, srv)
+	return gsrv, nil
+}
+
 func newgrpcServer(config *Config) (*grpcServer, error) {
 	return &grpcServer{
 		Config: config,
@@ -24,7 +107,18 @@ func newgrpcServer(config *Config) (*grpcServer, error) {
 }
 
 func (s *grpcServer) Produce(ctx context.Context, req *log_v1.ProduceRequest) (*log_v1.ProduceResponse, error) {
-	offset, err := s.CommitLog.Append(req.Record)
+	if err := s.authorize(ctx, req.Topic, produceAction); err != nil {
+		return nil, err
+	}
+	if req.Record == nil {
+		return nil, errNoRecord
+	}
+	l, err := s.log(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+
+	offset, _, err := appendBatch(l, []*log_v1.Record{req.Record}, req.Codec)
 	if err != nil {
 		return nil, err
 	}
@@ -34,8 +128,41 @@ func (s *grpcServer) Produce(ctx context.Context, req *log_v1.ProduceRequest) (*
 	}, nil
 }
 
+func (s *grpcServer) ProduceBatch(ctx context.Context, req *log_v1.ProduceBatchRequest) (*log_v1.ProduceBatchResponse, error) {
+	if err := s.authorize(ctx, req.Topic, produceAction); err != nil {
+		return nil, err
+	}
+	for _, record := range req.Records {
+		if record == nil {
+			return nil, errNoRecord
+		}
+	}
+	l, err := s.log(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+
+	first, last, err := appendBatch(l, req.Records, req.Codec)
+	if err != nil {
+		return nil, err
+	}
+
+	return &log_v1.ProduceBatchResponse{
+		FirstOffset: first,
+		LastOffset:  last,
+	}, nil
+}
+
 func (s *grpcServer) Consume(ctx context.Context, req *log_v1.ConsumeRequest) (*log_v1.ConsumeResponse, error) {
-	record, err := s.CommitLog.Read(req.Offset)
+	if err := s.authorize(ctx, req.Topic, consumeAction); err != nil {
+		return nil, err
+	}
+	l, err := s.log(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+
+	record, err := l.Read(req.Offset)
 	if err != nil {
 		return nil, err
 	}
@@ -43,6 +170,221 @@ func (s *grpcServer) Consume(ctx context.Context, req *log_v1.ConsumeRequest) (*
 	return &log_v1.ConsumeResponse{Record: record}, nil
 }
 
+func (s *grpcServer) OffsetForTime(ctx context.Context, req *log_v1.OffsetForTimeRequest) (*log_v1.OffsetForTimeResponse, error) {
+	if err := s.authorize(ctx, req.Topic, consumeAction); err != nil {
+		return nil, err
+	}
+	l, err := s.log(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+
+	offset, err := l.OffsetForTime(req.Time.AsTime())
+	if err != nil {
+		return nil, err
+	}
+
+	return &log_v1.OffsetForTimeResponse{Offset: offset}, nil
+}
+
+func (s *grpcServer) CreateTopic(ctx context.Context, req *log_v1.CreateTopicRequest) (*log_v1.CreateTopicResponse, error) {
+	if err := s.authorize(ctx, req.Name, manageAction); err != nil {
+		return nil, err
+	}
+	if s.Topics == nil {
+		return nil, errNoTopics
+	}
+
+	t, err := s.Topics.Create(req.Name, req.Partitions)
+	if err != nil {
+		return nil, err
+	}
+
+	return &log_v1.CreateTopicResponse{Topic: topicInfo(t)}, nil
+}
+
+func (s *grpcServer) DeleteTopic(ctx context.Context, req *log_v1.DeleteTopicRequest) (*log_v1.DeleteTopicResponse, error) {
+	if err := s.authorize(ctx, req.Name, manageAction); err != nil {
+		return nil, err
+	}
+	if s.Topics == nil {
+		return nil, errNoTopics
+	}
+
+	if err := s.Topics.Delete(req.Name); err != nil {
+		return nil, err
+	}
+
+	return &log_v1.DeleteTopicResponse{}, nil
+}
+
+func (s *grpcServer) ListTopics(ctx context.Context, req *log_v1.ListTopicsRequest) (*log_v1.ListTopicsResponse, error) {
+	res := &log_v1.ListTopicsResponse{}
+	if s.Topics == nil {
+		return res, nil
+	}
+
+	// callers only learn about the topics they may use
+	for _, t := range s.Topics.List() {
+		if !s.authorizedAny(ctx, t.Name) {
+			continue
+		}
+		res.Topics = append(res.Topics, topicInfo(t))
+	}
+	return res, nil
+}
+
+func (s *grpcServer) CommitOffset(ctx context.Context, req *log_v1.CommitOffsetRequest) (*log_v1.CommitOffsetResponse, error) {
+	if err := s.authorize(ctx, req.Topic, consumeAction); err != nil {
+		return nil, err
+	}
+	if s.Offsets == nil {
+		return nil, errNoGroups
+	}
+	// offsets are only committed for partitions that exist
+	if _, err := s.log(req.Topic, req.Partition); err != nil {
+		return nil, err
+	}
+	if err := s.fence(req.Group, req.MemberId, req.Generation, req.Topic, req.Partition); err != nil {
+		return nil, err
+	}
+
+	p := group.Partition{Topic: req.Topic, Partition: req.Partition}
+	if err := s.Offsets.Commit(req.Group, p, req.Offset); err != nil {
+		return nil, err
+	}
+
+	return &log_v1.CommitOffsetResponse{}, nil
+}
+
+func (s *grpcServer) FetchCommittedOffset(ctx context.Context, req *log_v1.FetchCommittedOffsetRequest) (*log_v1.FetchCommittedOffsetResponse, error) {
+	if err := s.authorize(ctx, req.Topic, consumeAction); err != nil {
+		return nil, err
+	}
+	if s.Offsets == nil {
+		return nil, errNoGroups
+	}
+
+	p := group.Partition{Topic: req.Topic, Partition: req.Partition}
+	offset, err := s.Offsets.Fetch(req.Group, p)
+	if err != nil {
+		return nil, err
+	}
+
+	return &log_v1.FetchCommittedOffsetResponse{Offset: offset}, nil
+}
+
+func (s *grpcServer) JoinGroup(ctx context.Context, req *log_v1.JoinGroupRequest) (*log_v1.JoinGroupResponse, error) {
+	for _, topic := range req.Topics {
+		if err := s.authorize(ctx, topic, consumeAction); err != nil {
+			return nil, err
+		}
+	}
+	if s.Coordinator == nil {
+		return nil, errNoGroups
+	}
+
+	strategy := group.StrategyRange
+	if req.Strategy == log_v1.AssignmentStrategy_ASSIGNMENT_STRATEGY_ROUND_ROBIN {
+		strategy = group.StrategyRoundRobin
+	}
+
+	m, err := s.Coordinator.Join(req.Group, req.MemberId, req.Topics, strategy)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &log_v1.JoinGroupResponse{
+		MemberId:   m.MemberID,
+		Generation: m.Generation,
+	}
+	for _, p := range m.Assignment {
+		res.Assignment = append(res.Assignment, &log_v1.TopicPartition{
+			Topic:     p.Topic,
+			Partition: p.Partition,
+		})
+	}
+	return res, nil
+}
+
+func (s *grpcServer) Heartbeat(ctx context.Context, req *log_v1.HeartbeatRequest) (*log_v1.HeartbeatResponse, error) {
+	if s.Coordinator == nil {
+		return nil, errNoGroups
+	}
+	if err := s.authorizeMember(ctx, req.Group, req.MemberId); err != nil {
+		return nil, err
+	}
+
+	if err := s.Coordinator.Heartbeat(req.Group, req.MemberId, req.Generation); err != nil {
+		return nil, err
+	}
+
+	return &log_v1.HeartbeatResponse{}, nil
+}
+
+func (s *grpcServer) LeaveGroup(ctx context.Context, req *log_v1.LeaveGroupRequest) (*log_v1.LeaveGroupResponse, error) {
+	if s.Coordinator == nil {
+		return nil, errNoGroups
+	}
+	if err := s.authorizeMember(ctx, req.Group, req.MemberId); err != nil {
+		return nil, err
+	}
+
+	if err := s.Coordinator.Leave(req.Group, req.MemberId); err != nil {
+		return nil, err
+	}
+
+	return &log_v1.LeaveGroupResponse{}, nil
+}
+
+func (s *grpcServer) GetServers(ctx context.Context, req *log_v1.GetServersRequest) (*log_v1.GetServersResponse, error) {
+	if s.GetServerer == nil {
+		return &log_v1.GetServersResponse{}, nil
+	}
+
+	servers, err := s.GetServerer.GetServers()
+	if err != nil {
+		return nil, err
+	}
+	return &log_v1.GetServersResponse{Servers: servers}, nil
+}
+
+func (s *grpcServer) GetLogInfo(ctx context.Context, req *log_v1.GetLogInfoRequest) (*log_v1.GetLogInfoResponse, error) {
+	if err := s.authorize(ctx, req.Topic, consumeAction); err != nil {
+		return nil, err
+	}
+	l, err := s.log(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := l.Info()
+	if err != nil {
+		return nil, err
+	}
+	res := &log_v1.GetLogInfoResponse{
+		LowWatermark:  info.LowestOffset,
+		HighWatermark: info.NextOffset,
+		SegmentCount:  uint32(len(info.Segments)),
+		Size:          info.Size,
+	}
+	if !info.LastAppend.IsZero() {
+		res.LastAppendTime = timestamppb.New(info.LastAppend)
+	}
+	for _, segment := range info.Segments {
+		si := &log_v1.SegmentInfo{
+			BaseOffset: segment.BaseOffset,
+			NextOffset: segment.NextOffset,
+			Size:       segment.Size,
+		}
+		if !segment.LastAppend.IsZero() {
+			si.LastAppendTime = timestamppb.New(segment.LastAppend)
+		}
+		res.Segments = append(res.Segments, si)
+	}
+	return res, nil
+}
+
 func (s *grpcServer) ProduceStream(stream log_v1.Log_ProduceStreamServer) error {
 	for {
 		req, err := stream.Recv()
@@ -62,24 +404,234 @@ func (s *grpcServer) ProduceStream(stream log_v1.Log_ProduceStreamServer) error
 }
 
 func (s *grpcServer) ConsumeStream(req *log_v1.ConsumeRequest, stream log_v1.Log_ConsumeStreamServer) error {
-	for {
-		select {
-		case <-stream.Context().Done():
-			return nil
-		default:
-			res, err := s.Consume(stream.Context(), req)
-			switch err.(type) {
-			case nil:
-			case log.ErrOffSetOutOfRange:
-				continue
-			default:
+	if err := s.authorize(stream.Context(), req.Topic, consumeAction); err != nil {
+		return err
+	}
+	if req.Group != "" {
+		if s.Offsets == nil {
+			return errNoGroups
+		}
+
+		p := group.Partition{Topic: req.Topic, Partition: req.Partition}
+		offset, err := s.Offsets.Fetch(req.Group, p)
+		switch {
+		case err == nil:
+			req.Offset = offset
+		case !errors.Is(err, group.ErrNoCommittedOffset):
+			return err
+		}
+	}
+
+	l, err := s.log(req.Topic, req.Partition)
+	if err != nil {
+		return err
+	}
+
+	ctx := stream.Context()
+	for ctx.Err() == nil {
+		// members of a group stop consuming once it rebalances
+		if req.Group != "" {
+			if err := s.fence(req.Group, req.MemberId, req.Generation, req.Topic, req.Partition); err != nil {
 				return err
 			}
+		}
+
+		// taken before reading so that records appended in between
+		// are not missed.
+		appended := l.Appended()
 
-			if err = stream.Send(res); err != nil {
+		res, err := s.Consume(ctx, req)
+		switch err := err.(type) {
+		case nil:
+		case log.ErrOffSetOutOfRange:
+			// records removed by retention will never be read
+			if err.Behind() {
 				return err
 			}
-			req.Offset++
+			select {
+			case <-appended:
+			case <-ctx.Done():
+			case <-s.Done:
+				return errStopping
+			}
+			continue
+		default:
+			return err
+		}
+
+		if err = stream.Send(res); err != nil {
+			return err
+		}
+		// compacted away offsets are skipped over
+		req.Offset = res.Record.Offset + 1
+	}
+	return nil
+}
+
+// authorize checks that the caller may take action on topic.
+func (s *grpcServer) authorize(ctx context.Context, topic, action string) error {
+	if s.Authorizer == nil {
+		return nil
+	}
+	object := topic
+	if object == "" {
+		object = auth.DefaultLog
+	}
+	return s.Authorizer.Authorize(subject(ctx), object, action)
+}
+
+// fence checks that a group's offsets of a partition are used by the
+// member of its current generation the partition is assigned to.
+// Groups without members are used by anyone, like consumers that
+// manage their partitions themselves.
+func (s *grpcServer) fence(group, memberID string, generation uint64, topic string, partition uint32) error {
+	if s.Coordinator == nil {
+		if memberID != "" {
+			return errNoGroups
+		}
+		return nil
+	}
+	if memberID == "" && !s.Coordinator.Active(group) {
+		return nil
+	}
+	return s.Coordinator.Owns(group, memberID, generation, topic, partition)
+}
+
+// authorizedAny reports whether the caller may take any action on topic.
+func (s *grpcServer) authorizedAny(ctx context.Context, topic string) bool {
+	for _, action := range []string{produceAction, consumeAction, manageAction} {
+		if s.authorize(ctx, topic, action) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizeMember checks that the caller may consume the topics of a
+// group's member, like it had to when the member joined.
+func (s *grpcServer) authorizeMember(ctx context.Context, group, memberID string) error {
+	if s.Authorizer == nil {
+		return nil
+	}
+	topics, err := s.Coordinator.Topics(group, memberID)
+	if err != nil {
+		return err
+	}
+	for _, topic := range topics {
+		if err := s.authorize(ctx, topic, consumeAction); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// log returns the log of a topic's partition, or the default log when
+// no topic is given.
+func (s *grpcServer) log(name string, partition uint32) (CommitLog, error) {
+	if name == "" {
+		if s.CommitLog == nil {
+			return nil, errNoCommitLog
+		}
+		return s.CommitLog, nil
+	}
+
+	if s.Topics == nil {
+		return nil, errNoTopics
+	}
+	return s.Topics.Partition(name, partition)
+}
+
+func topicInfo(t *topic.Topic) *log_v1.Topic {
+	return &log_v1.Topic{
+		Name:       t.Name,
+		Partitions: uint32(len(t.Partitions)),
+	}
+}
+
+// appendBatch appends the records with the codec requested by the
+// producer, or the log's configured codec when none was.
+func appendBatch(l CommitLog, records []*log_v1.Record, c log_v1.Codec) (first, last uint64, err error) {
+	if codec, ok := codec(c); ok {
+		return l.AppendBatchWithCodec(records, codec)
+	}
+	return l.AppendBatch(records)
+}
+
+// codec returns the log codec for the one requested by the producer.
+func codec(c log_v1.Codec) (log.Codec, bool) {
+	switch c {
+	case log_v1.Codec_CODEC_NONE:
+		return log.CodecNone, true
+	case log_v1.Codec_CODEC_GZIP:
+		return log.CodecGzip, true
+	case log_v1.Codec_CODEC_SNAPPY:
+		return log.CodecSnappy, true
+	case log_v1.Codec_CODEC_ZSTD:
+		return log.CodecZstd, true
+	case log_v1.Codec_CODEC_LZ4:
+		return log.CodecLZ4, true
+	default:
+		return 0, false
+	}
+}
+
+type subjectContextKey struct{}
+
+func subject(ctx context.Context) string {
+	subject, _ := ctx.Value(subjectContextKey{}).(string)
+	return subject
+}
+
+// authenticate names the caller of unary calls in their context.
+func authenticate(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	return handler(withSubject(ctx), req)
+}
+
+// authenticateStream names the caller of streaming calls in their
+// context.
+func authenticateStream(
+	srv interface{},
+	stream grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	return handler(srv, &authenticatedStream{
+		ServerStream: stream,
+		ctx:          withSubject(stream.Context()),
+	})
+}
+
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// withSubject names the caller by their certificate's common name when
+// they connected with TLS, by their metadata otherwise.
+func withSubject(ctx context.Context) context.Context {
+	var subject string
+	var tlsInfo credentials.TLSInfo
+	var isTLS bool
+	if p, ok := peer.FromContext(ctx); ok {
+		tlsInfo, isTLS = p.AuthInfo.(credentials.TLSInfo)
+	}
+	if isTLS {
+		if certs := tlsInfo.State.VerifiedChains; len(certs) > 0 && len(certs[0]) > 0 {
+			subject = certs[0][0].Subject.CommonName
+		}
+	} else if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(SubjectMetadataKey); len(values) > 0 {
+			subject = values[0]
 		}
 	}
+	return context.WithValue(ctx, subjectContextKey{}, subject)
 }
@@ -0,0 +1,526 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	log_v1 "github.com/reversearrow/distributed-computing-in-go/api/v1"
+	"github.com/reversearrow/distributed-computing-in-go/internal/auth"
+	"github.com/reversearrow/distributed-computing-in-go/internal/config"
+	"github.com/reversearrow/distributed-computing-in-go/internal/group"
+	"github.com/reversearrow/distributed-computing-in-go/internal/log"
+	"github.com/reversearrow/distributed-computing-in-go/internal/testutil"
+	"github.com/reversearrow/distributed-computing-in-go/internal/topic"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestServer(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, client log_v1.LogClient){
+		"produce/consume a record over mutual TLS": testProduceConsume,
+		"produce/consume a batch":                  testProduceConsumeBatch,
+		"consume past log boundary fails":          testConsumePastBoundary,
+		"produce without a record fails":           testProduceWithoutRecord,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			client, teardown := setupTest(t)
+			defer teardown()
+			fn(t, client)
+		})
+	}
+}
+
+func TestServerRequiresClientCertificate(t *testing.T) {
+	dir, err := os.MkdirTemp("", "server-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca, serverTLS := setupCerts(t, dir)
+	addr, teardown := serve(t, dir, serverTLS, nil)
+	defer teardown()
+
+	clientTLS, err := config.SetupTLSConfig(config.TLSConfig{
+		CAFile:        ca.CAFile,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(credentials.NewTLS(clientTLS)))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = log_v1.NewLogClient(conn).Produce(context.Background(), &log_v1.ProduceRequest{
+		Record: &log_v1.Record{Value: []byte("hello world")},
+	})
+	require.Error(t, err)
+}
+
+func TestServerAuthorizesCertificateSubjects(t *testing.T) {
+	dir, err := os.MkdirTemp("", "server-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	authorizer, err := auth.Parse(strings.NewReader(`
+root    @default produce
+root    @default consume
+reader  @default consume
+`))
+	require.NoError(t, err)
+
+	ca, serverTLS := setupCerts(t, dir)
+	addr, teardown := serve(t, dir, serverTLS, authorizer)
+	defer teardown()
+
+	clients := make(map[string]log_v1.LogClient)
+	for _, name := range []string{"root", "reader", "nobody"} {
+		certFile, keyFile, err := ca.Issue(name)
+		require.NoError(t, err)
+		clientTLS, err := config.SetupTLSConfig(config.TLSConfig{
+			CertFile:      certFile,
+			KeyFile:       keyFile,
+			CAFile:        ca.CAFile,
+			ServerAddress: "127.0.0.1",
+		})
+		require.NoError(t, err)
+		conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(credentials.NewTLS(clientTLS)))
+		require.NoError(t, err)
+		defer conn.Close()
+		clients[name] = log_v1.NewLogClient(conn)
+	}
+
+	ctx := context.Background()
+	produce := &log_v1.ProduceRequest{Record: &log_v1.Record{Value: []byte("hello world")}}
+	res, err := clients["root"].Produce(ctx, produce)
+	require.NoError(t, err)
+
+	_, err = clients["reader"].Produce(ctx, produce)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = clients["reader"].Consume(ctx, &log_v1.ConsumeRequest{Offset: res.Offset})
+	require.NoError(t, err)
+
+	_, err = clients["nobody"].Consume(ctx, &log_v1.ConsumeRequest{Offset: res.Offset})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	stream, err := clients["nobody"].ConsumeStream(ctx, &log_v1.ConsumeRequest{Offset: res.Offset})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestServerAuthorizesMetadataSubjects(t *testing.T) {
+	dir, err := os.MkdirTemp("", "server-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	authorizer, err := auth.Parse(strings.NewReader("root * *\n"))
+	require.NoError(t, err)
+	addr, teardown := serve(t, dir, nil, authorizer)
+	defer teardown()
+
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	client := log_v1.NewLogClient(conn)
+
+	produce := &log_v1.ProduceRequest{Record: &log_v1.Record{Value: []byte("hello world")}}
+	_, err = client.Produce(context.Background(), produce)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), SubjectMetadataKey, "root")
+	_, err = client.Produce(ctx, produce)
+	require.NoError(t, err)
+}
+
+func TestServerAuthorizesGroups(t *testing.T) {
+	dir, err := os.MkdirTemp("", "server-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	authorizer, err := auth.Parse(strings.NewReader(`
+hr      payroll consume
+billing orders  consume
+`))
+	require.NoError(t, err)
+	client, teardown := serveGroups(t, dir, authorizer)
+	defer teardown()
+	as := func(subject string) context.Context {
+		return metadata.AppendToOutgoingContext(context.Background(), SubjectMetadataKey, subject)
+	}
+
+	// callers only see the topics they are authorized for
+	list, err := client.ListTopics(as("billing"), &log_v1.ListTopicsRequest{})
+	require.NoError(t, err)
+	require.Len(t, list.Topics, 1)
+	require.Equal(t, "orders", list.Topics[0].Name)
+
+	join, err := client.JoinGroup(as("hr"), &log_v1.JoinGroupRequest{
+		Group:  "payroll-readers",
+		Topics: []string{"payroll"},
+	})
+	require.NoError(t, err)
+
+	// other callers may not heartbeat for, or remove, the member
+	_, err = client.Heartbeat(as("billing"), &log_v1.HeartbeatRequest{
+		Group:      "payroll-readers",
+		MemberId:   join.MemberId,
+		Generation: join.Generation,
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.LeaveGroup(as("billing"), &log_v1.LeaveGroupRequest{
+		Group:    "payroll-readers",
+		MemberId: join.MemberId,
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = client.Heartbeat(as("hr"), &log_v1.HeartbeatRequest{
+		Group:      "payroll-readers",
+		MemberId:   join.MemberId,
+		Generation: join.Generation,
+	})
+	require.NoError(t, err)
+	_, err = client.LeaveGroup(as("hr"), &log_v1.LeaveGroupRequest{
+		Group:    "payroll-readers",
+		MemberId: join.MemberId,
+	})
+	require.NoError(t, err)
+}
+
+func TestServerFencesGroups(t *testing.T) {
+	dir, err := os.MkdirTemp("", "server-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	client, teardown := serveGroups(t, dir, nil)
+	defer teardown()
+	ctx := context.Background()
+
+	commit := &log_v1.CommitOffsetRequest{
+		Group:  "billing",
+		Topic:  "orders",
+		Offset: 1,
+	}
+	// groups without members are used by anyone
+	_, err = client.CommitOffset(ctx, commit)
+	require.NoError(t, err)
+
+	a, err := client.JoinGroup(ctx, &log_v1.JoinGroupRequest{
+		Group:  "billing",
+		Topics: []string{"orders"},
+	})
+	require.NoError(t, err)
+
+	_, err = client.CommitOffset(ctx, commit)
+	require.Equal(t, codes.NotFound, status.Code(err))
+	commit.MemberId, commit.Generation = a.MemberId, a.Generation
+	_, err = client.CommitOffset(ctx, commit)
+	require.NoError(t, err)
+
+	consume := &log_v1.ConsumeRequest{Group: "billing", Topic: "orders"}
+	stream, err := client.ConsumeStream(ctx, consume)
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// the member's stream ends once another member joins
+	_, err = client.Produce(ctx, &log_v1.ProduceRequest{
+		Topic:  "orders",
+		Record: &log_v1.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	consume.Offset, consume.MemberId, consume.Generation = 0, a.MemberId, a.Generation
+	stream, err = client.ConsumeStream(ctx, consume)
+	require.NoError(t, err)
+
+	b, err := client.JoinGroup(ctx, &log_v1.JoinGroupRequest{
+		Group:  "billing",
+		Topics: []string{"orders"},
+	})
+	require.NoError(t, err)
+	_, err = client.Produce(ctx, &log_v1.ProduceRequest{
+		Topic:  "orders",
+		Record: &log_v1.Record{Value: []byte("after the rebalance")},
+	})
+	require.NoError(t, err)
+	for err == nil {
+		_, err = stream.Recv()
+	}
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// the only partition went to the first member, the second one
+	// neither commits nor consumes it
+	commit.MemberId, commit.Generation = b.MemberId, b.Generation
+	_, err = client.CommitOffset(ctx, commit)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	consume.MemberId, consume.Generation = b.MemberId, b.Generation
+	stream, err = client.ConsumeStream(ctx, consume)
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func setupTest(t *testing.T) (log_v1.LogClient, func()) {
+	t.Helper()
+
+	dir, err := os.MkdirTemp("", "server-test")
+	require.NoError(t, err)
+
+	ca, serverTLS := setupCerts(t, dir)
+	certFile, keyFile, err := ca.Issue("client")
+	require.NoError(t, err)
+	clientTLS, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      certFile,
+		KeyFile:       keyFile,
+		CAFile:        ca.CAFile,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+
+	addr, stop := serve(t, dir, serverTLS, nil)
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(credentials.NewTLS(clientTLS)))
+	require.NoError(t, err)
+
+	return log_v1.NewLogClient(conn), func() {
+		conn.Close()
+		stop()
+		os.RemoveAll(dir)
+	}
+}
+
+// setupCerts issues the server a certificate for 127.0.0.1 and returns
+// its TLS configuration, requiring client certificates.
+func setupCerts(t *testing.T, dir string) (*testutil.CA, *tls.Config) {
+	t.Helper()
+
+	ca, err := testutil.NewCA(dir)
+	require.NoError(t, err)
+	certFile, keyFile, err := ca.Issue("server", "127.0.0.1")
+	require.NoError(t, err)
+	serverTLS, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+		CAFile:   ca.CAFile,
+		Server:   true,
+	})
+	require.NoError(t, err)
+	return ca, serverTLS
+}
+
+// serve serves a log stored in dir, over TLS when serverTLS is set.
+// serveGroups serves the orders and payroll topics and their consumer
+// groups without TLS.
+func serveGroups(t *testing.T, dir string, authorizer Authorizer) (log_v1.LogClient, func()) {
+	t.Helper()
+
+	topics, err := topic.NewRegistry(filepath.Join(dir, "topics"), log.Config{})
+	require.NoError(t, err)
+	for _, name := range []string{"orders", "payroll"} {
+		_, err := topics.Create(name, 1)
+		require.NoError(t, err)
+	}
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "offsets"), 0755))
+	offsets, err := group.NewOffsets(filepath.Join(dir, "offsets"), log.Config{})
+	require.NoError(t, err)
+	coordinator := group.NewCoordinator(group.CoordinatorConfig{
+		Partitions: func(name string) (uint32, error) {
+			t, err := topics.Get(name)
+			if err != nil {
+				return 0, err
+			}
+			return uint32(len(t.Partitions)), nil
+		},
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv, err := NewGRPCServer(&Config{
+		Topics:      topics,
+		Offsets:     offsets,
+		Coordinator: coordinator,
+		Authorizer:  authorizer,
+	})
+	require.NoError(t, err)
+	go srv.Serve(ln)
+
+	conn, err := grpc.Dial(ln.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	return log_v1.NewLogClient(conn), func() {
+		conn.Close()
+		srv.Stop()
+		offsets.Close()
+		topics.Close()
+	}
+}
+
+func serve(t *testing.T, dir string, serverTLS *tls.Config, authorizer Authorizer) (string, func()) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	logDir := filepath.Join(dir, "log")
+	require.NoError(t, os.Mkdir(logDir, 0755))
+	clog, err := log.NewLog(logDir, log.Config{})
+	require.NoError(t, err)
+
+	var opts []grpc.ServerOption
+	if serverTLS != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(serverTLS)))
+	}
+	srv, err := NewGRPCServer(&Config{
+		CommitLog:  clog,
+		Authorizer: authorizer,
+	}, opts...)
+	require.NoError(t, err)
+
+	go srv.Serve(ln)
+	return ln.Addr().String(), func() {
+		srv.Stop()
+		clog.Close()
+	}
+}
+
+func testProduceConsume(t *testing.T, client log_v1.LogClient) {
+	ctx := context.Background()
+
+	want := &log_v1.Record{Value: []byte("hello world")}
+	produce, err := client.Produce(ctx, &log_v1.ProduceRequest{Record: want})
+	require.NoError(t, err)
+
+	consume, err := client.Consume(ctx, &log_v1.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+	require.Equal(t, want.Value, consume.Record.Value)
+	require.Equal(t, produce.Offset, consume.Record.Offset)
+}
+
+func testProduceConsumeBatch(t *testing.T, client log_v1.LogClient) {
+	ctx := context.Background()
+
+	values := []string{"first", "second", "third"}
+	var records []*log_v1.Record
+	for _, v := range values {
+		records = append(records, &log_v1.Record{Value: []byte(v)})
+	}
+	produce, err := client.ProduceBatch(ctx, &log_v1.ProduceBatchRequest{Records: records})
+	require.NoError(t, err)
+
+	for i, v := range values {
+		consume, err := client.Consume(ctx, &log_v1.ConsumeRequest{
+			Offset: produce.FirstOffset + uint64(i),
+		})
+		require.NoError(t, err)
+		require.Equal(t, v, string(consume.Record.Value))
+	}
+}
+
+func testConsumePastBoundary(t *testing.T, client log_v1.LogClient) {
+	ctx := context.Background()
+
+	produce, err := client.Produce(ctx, &log_v1.ProduceRequest{
+		Record: &log_v1.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+
+	consume, err := client.Consume(ctx, &log_v1.ConsumeRequest{Offset: produce.Offset + 1})
+	require.Nil(t, consume)
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+}
+
+func testProduceWithoutRecord(t *testing.T, client log_v1.LogClient) {
+	ctx := context.Background()
+
+	_, err := client.Produce(ctx, &log_v1.ProduceRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// missing records of a batch only reach the server from in-process
+	// callers, they are sent as empty records
+	srv, err := newgrpcServer(&Config{})
+	require.NoError(t, err)
+	_, err = srv.ProduceBatch(ctx, &log_v1.ProduceBatchRequest{
+		Records: []*log_v1.Record{{Value: []byte("first")}, nil},
+	})
+	require.ErrorIs(t, err, errNoRecord)
+}
+
+func testConsumeStream(t *testing.T, client log_v1.LogClient) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := client.ConsumeStream(ctx, &log_v1.ConsumeRequest{})
+	require.NoError(t, err)
+
+	records := make(chan *log_v1.Record)
+	go func() {
+		defer close(records)
+		for {
+			res, err := stream.Recv()
+			if err != nil {
+				return
+			}
+			records <- res.Record
+		}
+	}()
+
+	for _, v := range []string{"first", "second"} {
+		// the stream is idle until the record is produced
+		select {
+		case r := <-records:
+			t.Fatalf("unexpected record %q", r.Value)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		_, err := client.Produce(ctx, &log_v1.ProduceRequest{
+			Record: &log_v1.Record{Value: []byte(v)},
+		})
+		require.NoError(t, err)
+
+		select {
+		case r := <-records:
+			require.Equal(t, v, string(r.Value))
+		case <-time.After(time.Second):
+			t.Fatalf("record %q was not streamed", v)
+		}
+	}
+
+	// cancelling ends the stream
+	cancel()
+	for range records {
+	}
+}
+
+func testGetLogInfo(t *testing.T, client log_v1.LogClient) {
+	ctx := context.Background()
+
+	info, err := client.GetLogInfo(ctx, &log_v1.GetLogInfoRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), info.HighWatermark)
+	require.Nil(t, info.LastAppendTime)
+	require.Len(t, info.Segments, 1)
+	require.Nil(t, info.Segments[0].LastAppendTime)
+
+	for i := 0; i < 3; i++ {
+		_, err := client.Produce(ctx, &log_v1.ProduceRequest{
+			Record: &log_v1.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+
+	info, err = client.GetLogInfo(ctx, &log_v1.GetLogInfoRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), info.LowWatermark)
+	require.Equal(t, uint64(3), info.HighWatermark)
+	require.Equal(t, uint32(len(info.Segments)), info.SegmentCount)
+	require.NotZero(t, info.Size)
+	require.NotNil(t, info.LastAppendTime)
+
+	_, err = client.GetLogInfo(ctx, &log_v1.GetLogInfoRequest{Topic: "orders"})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
@@ -0,0 +1,273 @@
+package topic
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/reversearrow/distributed-computing-in-go/internal/log"
+)
+
+const (
+	defaultPartitions    = 1
+	defaultMaxPartitions = 256
+	maxNameLength        = 249
+)
+
+var (
+	ErrTopicNotFound     = errors.New("topic: topic not found")
+	ErrTopicExists       = errors.New("topic: topic already exists")
+	ErrPartitionNotFound = errors.New("topic: partition not found")
+	ErrInvalidName       = errors.New("topic: invalid topic name")
+	ErrTooManyPartitions = errors.New("topic: too many partitions")
+
+	validName = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+)
+
+// Topic is a named set of partitions, each partition being its own log.
+type Topic struct {
+	Name       string
+	Partitions []*log.Log
+}
+
+// Registry manages the topics stored under a directory. Every topic
+// lives in its own subdirectory holding one directory per partition:
+// <dir>/<topic>/<partition>.
+type Registry struct {
+	mu sync.RWMutex
+
+	Dir    string
+	Config log.Config
+	// MaxPartitions bounds the partitions of the topics created, as
+	// every partition holds open files and mappings of its own.
+	// defaultMaxPartitions when zero.
+	MaxPartitions uint32
+
+	topics map[string]*Topic
+}
+
+// NewRegistry opens the topics found in dir, creating it if needed.
+// Every partition log is opened with the given configuration.
+func NewRegistry(dir string, c log.Config) (*Registry, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	r := &Registry{
+		Dir:    dir,
+		Config: c,
+		topics: make(map[string]*Topic),
+	}
+	return r, r.setup()
+}
+
+func (r *Registry) setup() error {
+	entries, err := os.ReadDir(r.Dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || validateName(entry.Name()) != nil {
+			continue
+		}
+
+		t, err := r.open(entry.Name())
+		if err != nil {
+			r.Close()
+			return fmt.Errorf("opening topic %s: %w", entry.Name(), err)
+		}
+		r.topics[t.Name] = t
+	}
+	return nil
+}
+
+func (r *Registry) maxPartitions() uint32 {
+	if r.MaxPartitions == 0 {
+		return defaultMaxPartitions
+	}
+	return r.MaxPartitions
+}
+
+// open opens the partitions of an existing topic.
+func (r *Registry) open(name string) (*Topic, error) {
+	entries, err := os.ReadDir(filepath.Join(r.Dir, name))
+	if err != nil {
+		return nil, err
+	}
+
+	var partitions []int
+	for _, entry := range entries {
+		p, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		partitions = append(partitions, p)
+	}
+	sort.Ints(partitions)
+
+	t := &Topic{Name: name}
+	for i, p := range partitions {
+		if p != i {
+			return nil, fmt.Errorf("partition %d is missing", i)
+		}
+
+		l, err := log.NewLog(r.partitionDir(name, uint32(p)), r.Config)
+		if err != nil {
+			t.close()
+			return nil, err
+		}
+		t.Partitions = append(t.Partitions, l)
+	}
+	return t, nil
+}
+
+// Create creates a topic with the given number of partitions, one when
+// zero.
+func (r *Registry) Create(name string, partitions uint32) (*Topic, error) {
+	if err := validateName(name); err != nil {
+		return nil, err
+	}
+	if partitions == 0 {
+		partitions = defaultPartitions
+	}
+	if max := r.maxPartitions(); partitions > max {
+		return nil, fmt.Errorf("%w: %d, at most %d", ErrTooManyPartitions, partitions, max)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.topics[name]; ok {
+		return nil, fmt.Errorf("%w: %s", ErrTopicExists, name)
+	}
+
+	dir := filepath.Join(r.Dir, name)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	t := &Topic{Name: name}
+	for p := uint32(0); p < partitions; p++ {
+		pdir := r.partitionDir(name, p)
+		if err := os.Mkdir(pdir, 0755); err != nil {
+			t.close()
+			os.RemoveAll(dir)
+			return nil, err
+		}
+
+		l, err := log.NewLog(pdir, r.Config)
+		if err != nil {
+			t.close()
+			os.RemoveAll(dir)
+			return nil, err
+		}
+		t.Partitions = append(t.Partitions, l)
+	}
+
+	r.topics[name] = t
+	return t, nil
+}
+
+// Delete closes the partitions of a topic and removes its data.
+func (r *Registry) Delete(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t, ok := r.topics[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrTopicNotFound, name)
+	}
+	delete(r.topics, name)
+
+	if err := t.close(); err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(r.Dir, name))
+}
+
+// Get returns the topic with the given name.
+func (r *Registry) Get(name string) (*Topic, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	t, ok := r.topics[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrTopicNotFound, name)
+	}
+	return t, nil
+}
+
+// List returns the topics sorted by name.
+func (r *Registry) List() []*Topic {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	topics := make([]*Topic, 0, len(r.topics))
+	for _, t := range r.topics {
+		topics = append(topics, t)
+	}
+	sort.Slice(topics, func(i, j int) bool {
+		return topics[i].Name < topics[j].Name
+	})
+	return topics
+}
+
+// Partition returns the log of a topic's partition.
+func (r *Registry) Partition(name string, partition uint32) (*log.Log, error) {
+	t, err := r.Get(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if partition >= uint32(len(t.Partitions)) {
+		return nil, fmt.Errorf(
+			"%w: %s has %d partitions, got %d",
+			ErrPartitionNotFound, name, len(t.Partitions), partition,
+		)
+	}
+	return t.Partitions[partition], nil
+}
+
+// Close closes the partitions of every topic.
+func (r *Registry) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var err error
+	for _, t := range r.topics {
+		if cerr := t.close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (r *Registry) partitionDir(name string, partition uint32) string {
+	return filepath.Join(r.Dir, name, strconv.FormatUint(uint64(partition), 10))
+}
+
+// close closes the topic's partitions.
+func (t *Topic) close() error {
+	var err error
+	for _, l := range t.Partitions {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func validateName(name string) error {
+	if name == "." || name == ".." ||
+		len(name) > maxNameLength ||
+		!validName.MatchString(name) {
+		return fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+	return nil
+}
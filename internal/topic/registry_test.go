@@ -0,0 +1,86 @@
+package topic
+
+import (
+	"os"
+	"testing"
+
+	log_v1 "github.com/reversearrow/distributed-computing-in-go/api/v1"
+	"github.com/reversearrow/distributed-computing-in-go/internal/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	dir, err := os.MkdirTemp("", "registry-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	r, err := NewRegistry(dir, log.Config{})
+	require.NoError(t, err)
+	require.Empty(t, r.List())
+
+	orders, err := r.Create("orders", 3)
+	require.NoError(t, err)
+	require.Len(t, orders.Partitions, 3)
+
+	_, err = r.Create("orders", 1)
+	require.ErrorIs(t, err, ErrTopicExists)
+
+	for _, name := range []string{"", ".", "..", "a/b", "with space"} {
+		_, err = r.Create(name, 1)
+		require.ErrorIs(t, err, ErrInvalidName, name)
+	}
+
+	r.MaxPartitions = 3
+	_, err = r.Create("refunds", 4)
+	require.ErrorIs(t, err, ErrTooManyPartitions)
+	_, err = r.Get("refunds")
+	require.ErrorIs(t, err, ErrTopicNotFound)
+
+	payments, err := r.Create("payments", 0)
+	require.NoError(t, err)
+	require.Len(t, payments.Partitions, 1)
+
+	// partitions are independent logs
+	for p := uint32(0); p < 3; p++ {
+		l, err := r.Partition("orders", p)
+		require.NoError(t, err)
+		off, err := l.Append(&log_v1.Record{Value: []byte("order")})
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), off)
+	}
+
+	_, err = r.Partition("orders", 3)
+	require.ErrorIs(t, err, ErrPartitionNotFound)
+	_, err = r.Partition("unknown", 0)
+	require.ErrorIs(t, err, ErrTopicNotFound)
+
+	topics := r.List()
+	require.Len(t, topics, 2)
+	require.Equal(t, "orders", topics[0].Name)
+	require.Equal(t, "payments", topics[1].Name)
+
+	// topics are found again when the registry is reopened
+	require.NoError(t, r.Close())
+	r, err = NewRegistry(dir, log.Config{})
+	require.NoError(t, err)
+	require.Len(t, r.List(), 2)
+
+	l, err := r.Partition("orders", 2)
+	require.NoError(t, err)
+	read, err := l.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("order"), read.Value)
+
+	require.NoError(t, r.Delete("orders"))
+	require.ErrorIs(t, r.Delete("orders"), ErrTopicNotFound)
+	// partitions held while the topic is deleted are closed
+	_, err = l.Append(&log_v1.Record{Value: []byte("late order")})
+	require.ErrorIs(t, err, log.ErrClosed)
+	_, err = l.Read(0)
+	require.ErrorIs(t, err, log.ErrClosed)
+	_, err = os.Stat(dir + "/orders")
+	require.True(t, os.IsNotExist(err))
+	require.Len(t, r.List(), 1)
+
+	require.NoError(t, r.Close())
+}